@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+// Visibility settings of a session.
+const (
+	// VisibilityPublic sessions can be watched by everybody who knows their ID.
+	VisibilityPublic = "public"
+	// VisibilityPasscode sessions require the viewer to enter a passcode.
+	VisibilityPasscode = "passcode"
+	// VisibilitySignedIn sessions can only be watched by signed-in users.
+	VisibilitySignedIn = "signedin"
+	// VisibilityInvite sessions can only be watched by users who connected
+	// one of the allowed accounts.
+	VisibilityInvite = "invite"
+)
+
+// SessionAccess describes who may watch a session. The owner and the
+// co-presenters of a session may always watch it. ViewerToken is a random
+// value that viewers who entered the passcode get in a cookie; it changes
+// with the passcode.
+type SessionAccess struct {
+	Visibility   string   `meddler:"visibility" json:"visibility"`
+	PasscodeHash string   `meddler:"passcode_hash" json:"-"`
+	ViewerToken  string   `meddler:"viewer_token" json:"-"`
+	Allowed      []string `meddler:"-" json:"allowed"`
+}
+
+const (
+	// maxPasscodeFailures is the number of wrong passcodes that a client
+	// may enter for a session per passcodeFailureWindow. Limiting all
+	// clients of a session together would let anyone lock out its viewers.
+	maxPasscodeFailures   = 10
+	passcodeFailureWindow = 10 * time.Minute
+
+	// passcodeFailureDelay delays the response to a wrong passcode, and
+	// passcodeHashCost makes every attempt expensive, so that clients with
+	// many addresses can't guess passcodes quickly either.
+	passcodeFailureDelay = time.Second
+	passcodeHashCost     = 12
+)
+
+// AccessDeniedError is returned by authorizeViewer if the user of a request
+// may not watch a session.
+type AccessDeniedError struct {
+	Visibility string
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("access to %s session denied", e.Visibility)
+}
+
+// sessionAccessRequest is sent by the owner of a session to change who may
+// watch it. An empty passcode keeps the current passcode.
+type sessionAccessRequest struct {
+	Visibility string   `json:"visibility"`
+	Passcode   string   `json:"passcode"`
+	Allowed    []string `json:"allowed"`
+}
+
+// apply returns the SessionAccess that results from applying the request to
+// the current access settings.
+func (req *sessionAccessRequest) apply(current *SessionAccess) (*SessionAccess, error) {
+	access := &SessionAccess{Visibility: req.Visibility, Allowed: req.Allowed}
+	if access.Visibility == "" {
+		access.Visibility = VisibilityPublic
+	}
+	if access.Allowed == nil {
+		access.Allowed = []string{}
+	}
+
+	switch access.Visibility {
+	case VisibilityPublic, VisibilitySignedIn, VisibilityInvite:
+	case VisibilityPasscode:
+		if req.Passcode == "" {
+			if current == nil || current.PasscodeHash == "" {
+				return nil, errors.New("passcode required")
+			}
+			access.PasscodeHash = current.PasscodeHash
+			access.ViewerToken = current.ViewerToken
+			if access.ViewerToken != "" {
+				break
+			}
+		} else {
+			hash, err := bcrypt.GenerateFromPassword([]byte(req.Passcode), passcodeHashCost)
+			if err != nil {
+				return nil, err
+			}
+			access.PasscodeHash = string(hash)
+		}
+		token, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		access.ViewerToken = token
+	default:
+		return nil, fmt.Errorf("unknown visibility %s", access.Visibility)
+	}
+
+	return access, nil
+}
+
+// viewerTokenName returns the name of the cookie that holds the viewer token
+// for a session, identified by its publicID.
+func viewerTokenName(publicID string) string {
+	return "SATSUMA_VIEWER_" + publicID
+}
+
+// viewerTokenValue returns the content of a viewer token for a session. It
+// contains the session's random viewer token, which is replaced whenever the
+// passcode changes, so that this invalidates all tokens that have been
+// issued before.
+func viewerTokenValue(publicID string, access *SessionAccess) string {
+	return publicID + ":" + access.ViewerToken
+}
+
+// authorizeViewer checks whether the user of a request may watch a session,
+// identified by its publicID, and returns the session's numeric ID. If the
+// user may not watch it, the error is an *AccessDeniedError.
+func authorizeViewer(r *http.Request, publicID string, dbStore Store, sessionStore sessions.Store, secureCookie *securecookie.SecureCookie) (int, error) {
+	ownerID, sessionID, err := dbStore.GetOwnerForSession(publicID)
+	if err != nil {
+		return 0, err
+	}
+
+	userID := 0
+	if session, err := sessionStore.Get(r, SESSIONNAME); err == nil {
+		userID, _ = session.Values["userID"].(int)
+	}
+
+	if userID != 0 && canPresent(dbStore, ownerID, sessionID, userID) {
+		return sessionID, nil
+	}
+
+	access, err := dbStore.GetSessionAccess(sessionID)
+	if err != nil {
+		return 0, err
+	}
+
+	allowed := false
+	switch access.Visibility {
+	case VisibilityPublic:
+		allowed = true
+	case VisibilitySignedIn:
+		allowed = userID != 0
+	case VisibilityInvite:
+		if userID != 0 {
+			if allowed, err = dbStore.IsAllowedViewer(sessionID, userID); err != nil {
+				return 0, err
+			}
+		}
+	case VisibilityPasscode:
+		if cookie, err := r.Cookie(viewerTokenName(publicID)); err == nil && access.ViewerToken != "" {
+			var token string
+			if err := secureCookie.Decode(viewerTokenName(publicID), cookie.Value, &token); err == nil {
+				allowed = token == viewerTokenValue(publicID, access)
+			}
+		}
+	}
+
+	if !allowed {
+		StatCount("viewer access denied", 1)
+		return 0, &AccessDeniedError{Visibility: access.Visibility}
+	}
+	return sessionID, nil
+}
+
+// writeAccessError responds to a request that authorizeViewer rejected. The
+// response tells the client what it needs to do to get access.
+func writeAccessError(w http.ResponseWriter, err error) {
+	if accessErr, ok := err.(*AccessDeniedError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": accessErr.Error(), "visibility": accessErr.Visibility})
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusNotFound)
+}
+
+// SessionPasscodeHandler checks the passcode of a session and, if it is
+// correct, issues a viewer token for the session. Wrong passcodes are
+// limited per client and session, so that passcodes can't be guessed.
+type SessionPasscodeHandler struct {
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+
+	failures *rateLimiter
+}
+
+// NewSessionPasscodeHandler creates a new SessionPasscodeHandler.
+func NewSessionPasscodeHandler(dbStore Store, secureCookie *securecookie.SecureCookie) *SessionPasscodeHandler {
+	return &SessionPasscodeHandler{
+		DBStore:      dbStore,
+		SecureCookie: secureCookie,
+		failures:     newRateLimiter(maxPasscodeFailures, passcodeFailureWindow),
+	}
+}
+
+func (h *SessionPasscodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	StatCount("session passcode", 1)
+
+	requestData := struct {
+		PublicID string `json:"session_id"`
+		Passcode string `json:"passcode"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, sessionID, err := h.DBStore.GetOwnerForSession(requestData.PublicID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	key := clientAddr(r) + " " + requestData.PublicID
+	if h.failures.Limited(key) {
+		StatCount("session passcode throttled", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(passcodeFailureWindow/time.Second)))
+		http.Error(w, "too many wrong passcodes, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	access, err := h.DBStore.GetSessionAccess(sessionID)
+	if err != nil {
+		xlog.Errorf("Querying access of session %d failed: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if access.Visibility != VisibilityPasscode || access.ViewerToken == "" || bcrypt.CompareHashAndPassword([]byte(access.PasscodeHash), []byte(requestData.Passcode)) != nil {
+		StatCount("wrong session passcode", 1)
+		h.failures.Add(key)
+		time.Sleep(passcodeFailureDelay)
+		http.Error(w, "wrong passcode", http.StatusForbidden)
+		return
+	}
+
+	name := viewerTokenName(requestData.PublicID)
+	token, err := h.SecureCookie.Encode(name, viewerTokenValue(requestData.PublicID, access))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: name, Value: token, Path: "/", HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSessionAccessHandler returns who may watch a session. Only the owner
+// of the session may see this.
+type GetSessionAccessHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+}
+
+func (h *GetSessionAccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if session.Values["userID"] == nil {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("get session access", 1)
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(r.URL.Query().Get(":id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if ownerID != session.Values["userID"].(int) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	access, err := h.DBStore.GetSessionAccess(sessionID)
+	if err != nil {
+		xlog.Errorf("Querying access of session %d failed: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(access)
+}
+
+// SetSessionAccessHandler changes who may watch a session.
+type SetSessionAccessHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *SetSessionAccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if session.Values["userID"] == nil {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("set session access", 1)
+
+	requestData := struct {
+		PublicID string `json:"session_id"`
+		sessionAccessRequest
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(requestData.PublicID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if ownerID != session.Values["userID"].(int) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	current, err := h.DBStore.GetSessionAccess(sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	access, err := requestData.apply(current)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.DBStore.SetSessionAccess(sessionID, access); err != nil {
+		xlog.Errorf("Setting access of session %s failed: %v", requestData.PublicID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
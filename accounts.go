@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+// pendingMergeLifetime is how long a merge waits for the user's
+// confirmation.
+const pendingMergeLifetime = 10 * time.Minute
+
+// ErrLastAccount is returned when removing accounts would leave a user
+// without any way to log in.
+var ErrLastAccount = errors.New("can't remove the last account")
+
+// MergeInfo describes what is merged into the current user when an account
+// that belongs to another user is connected.
+type MergeInfo struct {
+	Account    string `json:"account"`
+	FromUserID int    `json:"-"`
+	Uploads    int    `json:"uploads"`
+}
+
+// MergeLogEntry records that the user of an account has been merged into
+// another user. The IDs of the uploads that have been moved are stored in
+// merge_log_uploads.
+type MergeLogEntry struct {
+	ID         int       `meddler:"id,pk"`
+	Merged     time.Time `meddler:"merged,utctimez"`
+	Account    string    `meddler:"account"`
+	FromUserID int       `meddler:"from_user_id"`
+	ToUserID   int       `meddler:"to_user_id"`
+}
+
+// accountSystem returns the auth service identifier of an account,
+// identified by its username, or an empty string if it is unknown.
+func accountSystem(username string, oidc *OIDCLogin) string {
+	if system := oidc.System(username); system != "" {
+		return system
+	}
+	for prefix, system := range connectedSystems {
+		if strings.HasPrefix(username, prefix+":") {
+			return system
+		}
+	}
+	return ""
+}
+
+// setPendingMerge remembers in the session that connecting an account,
+// identified by its username, needs to be confirmed by the user.
+func setPendingMerge(w http.ResponseWriter, r *http.Request, session *sessions.Session, username string) {
+	session.Values["pendingMerge"] = username
+	session.Values["pendingMergeTime"] = time.Now().Unix()
+	session.Save(r, w)
+}
+
+// pendingMerge returns the username of the account that waits for the
+// user's confirmation to be connected, or an empty string.
+func pendingMerge(session *sessions.Session) string {
+	username, _ := session.Values["pendingMerge"].(string)
+	since, _ := session.Values["pendingMergeTime"].(int64)
+	if username == "" || time.Since(time.Unix(since, 0)) > pendingMergeLifetime {
+		return ""
+	}
+	return username
+}
+
+func clearPendingMerge(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	delete(session.Values, "pendingMerge")
+	delete(session.Values, "pendingMergeTime")
+	session.Save(r, w)
+}
+
+// MergeHandler shows (GET) and confirms or cancels (POST) the pending merge
+// of the current user with the user of an account that has been connected.
+type MergeHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *MergeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Errorf("Error fetching session: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	username := pendingMerge(session)
+
+	if r.Method != "POST" {
+		var info *MergeInfo
+		if username != "" {
+			if info, err = h.DBStore.GetMergeInfo(username, userID); err != nil {
+				xlog.Errorf("Getting merge info for %s failed: %v", username, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if info == nil {
+			info = &MergeInfo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+
+	data := struct {
+		Confirm bool `json:"confirm"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if username == "" {
+		http.Error(w, "no pending merge", http.StatusNotFound)
+		return
+	}
+
+	clearPendingMerge(w, r, session)
+
+	if data.Confirm {
+		StatCount("merge confirmed", 1)
+		if err := h.DBStore.AddUser(username, userID); err != nil {
+			xlog.Errorf("Merging %s into userID %d failed: %v", username, userID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		StatCount("merge cancelled", 1)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlinkHandler removes the accounts of an auth service from the current
+// user. It refuses to remove the last account, as the user couldn't log in
+// anymore.
+type UnlinkHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+	OIDC         *OIDCLogin
+}
+
+func (h *UnlinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Errorf("Error fetching session: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	data := struct {
+		System string `json:"system"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	usernames := []string{}
+	for _, username := range h.DBStore.GetAccountsForUser(userID) {
+		if accountSystem(username, h.OIDC) == data.System {
+			usernames = append(usernames, username)
+		}
+	}
+
+	if len(usernames) == 0 {
+		http.Error(w, "account not connected", http.StatusNotFound)
+		return
+	}
+
+	if err := h.DBStore.RemoveAccounts(userID, usernames); err == ErrLastAccount {
+		http.Error(w, "you can't remove the only account you can sign in with", http.StatusConflict)
+		return
+	} else if err != nil {
+		xlog.Errorf("Removing accounts %v of userID %d failed: %v", usernames, userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	StatCount("unlink account", 1)
+
+	w.WriteHeader(http.StatusNoContent)
+}
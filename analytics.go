@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+// ViewerSample records how many viewers followed a session at some point in time.
+type ViewerSample struct {
+	ID        int       `meddler:"id,pk" json:"-"`
+	SessionID int       `meddler:"session_id" json:"-"`
+	Sampled   time.Time `meddler:"sampled,utctimez" json:"time"`
+	Viewers   int       `meddler:"viewers" json:"viewers"`
+}
+
+// SlideStats describes how a single slide was presented. Seconds is the
+// total time the slide was shown, Visits how often the presenter went to it.
+type SlideStats struct {
+	Page        int     `json:"page"`
+	Seconds     float64 `json:"seconds"`
+	Visits      int     `json:"visits"`
+	Annotations int     `json:"annotations"`
+}
+
+// SessionAnalytics summarizes a session for its presenters. Viewers holds the
+// highest viewer count of every minute of the session.
+type SessionAnalytics struct {
+	Started     time.Time       `json:"started"`
+	Ended       string          `json:"ended,omitempty"`
+	Duration    float64         `json:"duration"`
+	PeakViewers int             `json:"peak_viewers"`
+	Slides      []*SlideStats   `json:"slides"`
+	Viewers     []*ViewerSample `json:"viewers"`
+}
+
+// buildAnalytics computes the analytics of a session from its recording and
+// viewer samples. Sessions that are still running are evaluated up to now.
+func buildAnalytics(recording *SessionRecording, samples []*ViewerSample, now time.Time) *SessionAnalytics {
+	end := now
+	analytics := &SessionAnalytics{Started: recording.Started, PeakViewers: recording.PeakViewers}
+	if !recording.Ended.IsZero() {
+		end = recording.Ended
+		analytics.Ended = recording.Ended.Format(time.RFC3339)
+	}
+	analytics.Duration = end.Sub(recording.Started).Seconds()
+
+	slides := make(map[int]*SlideStats)
+	slide := func(page int) *SlideStats {
+		if slides[page] == nil {
+			slides[page] = &SlideStats{Page: page}
+		}
+		return slides[page]
+	}
+
+	// every session starts on the first page.
+	page, since := 1, recording.Started
+	slide(page).Visits++
+
+	for _, cmd := range recording.Cmds {
+		switch cmd.Cmd {
+		case "gotoPage":
+			if cmd.Page == page {
+				continue
+			}
+			slide(page).Seconds += cmd.Timestamp.Sub(since).Seconds()
+			page, since = cmd.Page, cmd.Timestamp
+			slide(page).Visits++
+		case "drawLine":
+			slide(cmd.Page).Annotations++
+		}
+	}
+	if end.After(since) {
+		slide(page).Seconds += end.Sub(since).Seconds()
+	}
+
+	analytics.Slides = make([]*SlideStats, 0, len(slides))
+	for _, stats := range slides {
+		analytics.Slides = append(analytics.Slides, stats)
+	}
+	sort.Slice(analytics.Slides, func(i, j int) bool { return analytics.Slides[i].Page < analytics.Slides[j].Page })
+
+	analytics.Viewers = viewersPerMinute(samples, recording.Started, end)
+
+	return analytics
+}
+
+// viewersPerMinute condenses viewer samples to the highest count of every
+// minute between start and end. Minutes without samples keep the count of
+// the previous minute.
+func viewersPerMinute(samples []*ViewerSample, start, end time.Time) []*ViewerSample {
+	result := []*ViewerSample{}
+	if len(samples) == 0 {
+		return result
+	}
+
+	current := 0
+	next := 0
+	for minute := start.Truncate(time.Minute); !minute.After(end); minute = minute.Add(time.Minute) {
+		highest := current
+		for next < len(samples) && samples[next].Sampled.Before(minute.Add(time.Minute)) {
+			current = samples[next].Viewers
+			if current > highest {
+				highest = current
+			}
+			next++
+		}
+		result = append(result, &ViewerSample{Sampled: minute, Viewers: highest})
+	}
+
+	return result
+}
+
+// AnalyticsHandler delivers the analytics of a session to its presenters,
+// either as JSON or, if CSV is set, as CSV. The CSV contains either the
+// statistics of all slides or, with table=viewers, the viewer counts.
+type AnalyticsHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	CSV          bool
+}
+
+func (h *AnalyticsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("session analytics", 1)
+
+	publicID := r.URL.Query().Get(":id")
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(publicID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !canPresent(h.DBStore, ownerID, sessionID, userID) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	recording, err := h.DBStore.GetSessionRecording(sessionID)
+	if err != nil {
+		xlog.Errorf("Getting recording of session %d failed: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	samples, err := h.DBStore.GetViewerSamples(sessionID)
+	if err != nil {
+		xlog.Errorf("Getting viewer samples of session %d failed: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	analytics := buildAnalytics(recording, samples, time.Now().UTC())
+
+	if !h.CSV {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(analytics)
+		return
+	}
+
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		table = "slides"
+	}
+
+	var rows [][]string
+	switch table {
+	case "slides":
+		rows = append(rows, []string{"page", "seconds", "visits", "annotations"})
+		for _, stats := range analytics.Slides {
+			rows = append(rows, []string{strconv.Itoa(stats.Page), strconv.FormatFloat(stats.Seconds, 'f', 1, 64), strconv.Itoa(stats.Visits), strconv.Itoa(stats.Annotations)})
+		}
+	case "viewers":
+		rows = append(rows, []string{"time", "viewers"})
+		for _, sample := range analytics.Viewers {
+			rows = append(rows, []string{sample.Sampled.Format(time.RFC3339), strconv.Itoa(sample.Viewers)})
+		}
+	default:
+		http.Error(w, "unknown table "+table, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": publicID + "-" + table + ".csv"}))
+	csv.NewWriter(w).WriteAll(rows)
+}
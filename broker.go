@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/joinmytalk/xlog"
+	"sync"
+)
+
+// Broker distributes the commands of a session to everyone following it.
+type Broker interface {
+	// Publish sends a command to all current subscribers of a session.
+	Publish(sessionID int, cmd *Command) error
+
+	// Subscribe returns a Subscription that receives all commands published
+	// for a session from now on.
+	Subscribe(sessionID int) (Subscription, error)
+
+	// AddViewer registers a viewer connection, identified by connID, with
+	// a session.
+	AddViewer(sessionID int, connID string) error
+
+	// RemoveViewer unregisters a viewer connection from a session.
+	RemoveViewer(sessionID int, connID string) error
+
+	// CountViewers returns the number of viewer connections of a session
+	// across all satsuma instances sharing the broker.
+	CountViewers(sessionID int) (int, error)
+}
+
+// Subscription receives the commands published for a session.
+type Subscription interface {
+	// Receive blocks until the next command is available.
+	Receive() (*Command, error)
+
+	// Close ends the subscription.
+	Close() error
+}
+
+var errSubscriptionClosed = errors.New("subscription closed")
+
+// NewBroker creates a Broker of the specified kind.
+func NewBroker(kind, redisAddr string) (Broker, error) {
+	switch kind {
+	case "redis":
+		return NewRedisBroker(redisAddr), nil
+	case "local":
+		return NewLocalBroker(), nil
+	}
+	return nil, fmt.Errorf("unsupported broker %s", kind)
+}
+
+// LocalBroker is an in-process Broker that fans out commands to all
+// subscribers within the same satsuma process. It is meant for single-node
+// deployments, demos and tests.
+type LocalBroker struct {
+	fanout  *fanout
+	viewers *viewerSet
+}
+
+// NewLocalBroker creates a new LocalBroker.
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{fanout: newFanout(nil), viewers: newViewerSet()}
+}
+
+// Publish sends a command to all subscribers of a session.
+func (b *LocalBroker) Publish(sessionID int, cmd *Command) error {
+	b.fanout.publish(sessionID, cmd)
+	return nil
+}
+
+// Subscribe subscribes to the commands of a session.
+func (b *LocalBroker) Subscribe(sessionID int) (Subscription, error) {
+	sub, _ := b.fanout.subscribe(sessionID)
+	return sub, nil
+}
+
+// AddViewer registers a viewer connection with a session.
+func (b *LocalBroker) AddViewer(sessionID int, connID string) error {
+	b.viewers.add(sessionID, connID)
+	return nil
+}
+
+// RemoveViewer unregisters a viewer connection from a session.
+func (b *LocalBroker) RemoveViewer(sessionID int, connID string) error {
+	b.viewers.remove(sessionID, connID)
+	return nil
+}
+
+// CountViewers returns the number of viewer connections of a session.
+func (b *LocalBroker) CountViewers(sessionID int) (int, error) {
+	return b.viewers.count(sessionID), nil
+}
+
+// viewerSet keeps track of the viewer connections within this process,
+// grouped by session.
+type viewerSet struct {
+	mtx     sync.Mutex
+	viewers map[int]map[string]bool
+}
+
+func newViewerSet() *viewerSet {
+	return &viewerSet{viewers: make(map[int]map[string]bool)}
+}
+
+func (v *viewerSet) add(sessionID int, connID string) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if v.viewers[sessionID] == nil {
+		v.viewers[sessionID] = make(map[string]bool)
+	}
+	v.viewers[sessionID][connID] = true
+}
+
+func (v *viewerSet) remove(sessionID int, connID string) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	delete(v.viewers[sessionID], connID)
+	if len(v.viewers[sessionID]) == 0 {
+		delete(v.viewers, sessionID)
+	}
+}
+
+func (v *viewerSet) count(sessionID int) int {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	return len(v.viewers[sessionID])
+}
+
+// all returns a copy of all viewer connections.
+func (v *viewerSet) all() map[int][]string {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	result := make(map[int][]string, len(v.viewers))
+	for sessionID, conns := range v.viewers {
+		for connID := range conns {
+			result[sessionID] = append(result[sessionID], connID)
+		}
+	}
+	return result
+}
+
+// localSubscriptionBuffer is the number of commands that are queued for a
+// subscriber before it is considered too slow and gets dropped.
+const localSubscriptionBuffer = 128
+
+// fanout distributes commands to the subscriptions within this process,
+// grouped by session.
+type fanout struct {
+	mtx         sync.Mutex
+	subscribers map[int]map[*localSubscription]bool
+
+	// released is called when the last subscription of a session ends.
+	released func(sessionID int)
+}
+
+func newFanout(released func(sessionID int)) *fanout {
+	return &fanout{subscribers: make(map[int]map[*localSubscription]bool), released: released}
+}
+
+// subscribe adds a new subscription for a session. first is true if there
+// was no other subscription for this session.
+func (f *fanout) subscribe(sessionID int) (sub *localSubscription, first bool) {
+	sub = &localSubscription{
+		fanout:    f,
+		sessionID: sessionID,
+		cmds:      make(chan *Command, localSubscriptionBuffer),
+		done:      make(chan struct{}),
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.subscribers[sessionID] == nil {
+		f.subscribers[sessionID] = make(map[*localSubscription]bool)
+		first = true
+	}
+	f.subscribers[sessionID][sub] = true
+
+	return sub, first
+}
+
+func (f *fanout) publish(sessionID int, cmd *Command) {
+	f.mtx.Lock()
+	last := false
+	for sub := range f.subscribers[sessionID] {
+		c := *cmd
+		select {
+		case sub.cmds <- &c:
+		default:
+			xlog.Errorf("fanout: subscriber of session %d is too slow, dropping it", sessionID)
+			StatCount("slow subscriber dropped", 1)
+			last = f.remove(sub)
+		}
+	}
+	f.mtx.Unlock()
+
+	if last && f.released != nil {
+		f.released(sessionID)
+	}
+}
+
+// remove removes a subscription and returns whether it was the last one of
+// its session. f.mtx must be held.
+func (f *fanout) remove(sub *localSubscription) bool {
+	sub.once.Do(func() { close(sub.done) })
+
+	subs, ok := f.subscribers[sub.sessionID]
+	if !ok || !subs[sub] {
+		return false
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(f.subscribers, sub.sessionID)
+		return true
+	}
+	return false
+}
+
+// has returns whether there are any subscriptions for a session.
+func (f *fanout) has(sessionID int) bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return len(f.subscribers[sessionID]) > 0
+}
+
+// sessions returns the IDs of all sessions with subscriptions.
+func (f *fanout) sessions() []int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	ids := make([]int, 0, len(f.subscribers))
+	for id := range f.subscribers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// count returns the total number of subscriptions.
+func (f *fanout) count() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	n := 0
+	for _, subs := range f.subscribers {
+		n += len(subs)
+	}
+	return n
+}
+
+type localSubscription struct {
+	fanout    *fanout
+	sessionID int
+	cmds      chan *Command
+	done      chan struct{}
+	once      sync.Once
+}
+
+func (s *localSubscription) Receive() (*Command, error) {
+	select {
+	case cmd := <-s.cmds:
+		return cmd, nil
+	case <-s.done:
+		return nil, errSubscriptionClosed
+	}
+}
+
+func (s *localSubscription) Close() error {
+	s.fanout.mtx.Lock()
+	last := s.fanout.remove(s)
+	s.fanout.mtx.Unlock()
+
+	if last && s.fanout.released != nil {
+		s.fanout.released(s.sessionID)
+	}
+	return nil
+}
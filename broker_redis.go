@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/joinmytalk/xlog"
+	"sync"
+	"time"
+)
+
+const (
+	// redisSubscribeTimeout is how long Subscribe waits for Redis to confirm
+	// a new channel subscription.
+	redisSubscribeTimeout = 5 * time.Second
+
+	// redisStatsInterval is the interval in which pool and subscriber
+	// metrics are reported.
+	redisStatsInterval = 30 * time.Second
+
+	// redisViewerTTL is how long a viewer connection counts as present
+	// without being refreshed, e.g. after its satsuma instance crashed.
+	redisViewerTTL = 90 * time.Second
+
+	// redisViewerRefreshInterval is the interval in which the viewer
+	// connections of this process are refreshed.
+	redisViewerRefreshInterval = 30 * time.Second
+
+	// redisMaxIdle and redisMaxActive bound the idle and the total number
+	// of pooled connections. Once redisMaxActive connections are in use,
+	// callers wait for one to be returned to the pool.
+	redisMaxIdle   = 8
+	redisMaxActive = 64
+)
+
+// RedisBroker is a Broker that publishes commands to the Redis channel
+// session.<id>, so that viewers can be spread across several satsuma
+// instances.
+//
+// Commands are published through a connection pool of at most
+// redisMaxActive connections. All subscriptions of this process share a
+// single Redis subscriber connection, which subscribes to a session's
+// channel as long as there are local subscribers for it and fans incoming
+// commands out to them.
+//
+// Viewer connections are tracked in the sorted set viewers.<id>, scored by
+// the time until which they count as present.
+type RedisBroker struct {
+	Addr string
+
+	pool    *redis.Pool
+	fanout  *fanout
+	viewers *viewerSet
+
+	// mtx guards all fields below; writes to psc must hold it.
+	mtx     sync.Mutex
+	psc     *redis.PubSubConn
+	active  map[int]bool
+	waiting map[int][]chan struct{}
+}
+
+// NewRedisBroker creates a new RedisBroker for the Redis server at addr and
+// starts its subscriber connection.
+func NewRedisBroker(addr string) *RedisBroker {
+	b := &RedisBroker{
+		Addr: addr,
+		pool: &redis.Pool{
+			MaxIdle:     redisMaxIdle,
+			MaxActive:   redisMaxActive,
+			Wait:        true,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr)
+			},
+			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				if time.Since(t) < time.Minute {
+					return nil
+				}
+				_, err := c.Do("PING")
+				return err
+			},
+		},
+		viewers: newViewerSet(),
+		active:  make(map[int]bool),
+		waiting: make(map[int][]chan struct{}),
+	}
+	b.fanout = newFanout(b.release)
+
+	go b.receiveLoop()
+	go b.reportStats()
+	go b.refreshViewers()
+
+	return b
+}
+
+func sessionChannel(sessionID int) string {
+	return fmt.Sprintf("session.%d", sessionID)
+}
+
+func sessionIDFromChannel(channel string) (sessionID int, ok bool) {
+	_, err := fmt.Sscanf(channel, "session.%d", &sessionID)
+	return sessionID, err == nil
+}
+
+// Publish publishes a command to the channel of a session.
+func (b *RedisBroker) Publish(sessionID int, cmd *Command) error {
+	cmdJSON, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	c := b.pool.Get()
+	defer c.Close()
+
+	if _, err := c.Do("PUBLISH", sessionChannel(sessionID), string(cmdJSON)); err != nil {
+		xlog.Errorf("RedisBroker: PUBLISH failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Subscribe subscribes to the commands of a session. It returns as soon as
+// Redis has confirmed the subscription of the session's channel.
+func (b *RedisBroker) Subscribe(sessionID int) (Subscription, error) {
+	sub, first := b.fanout.subscribe(sessionID)
+
+	var ready chan struct{}
+
+	b.mtx.Lock()
+	if !b.active[sessionID] {
+		ready = make(chan struct{})
+		b.waiting[sessionID] = append(b.waiting[sessionID], ready)
+		// without a connection, receiveLoop subscribes as soon as it has reconnected.
+		if first && b.psc != nil {
+			if err := b.psc.Subscribe(sessionChannel(sessionID)); err != nil {
+				xlog.Errorf("RedisBroker: SUBSCRIBE failed: %v", err)
+			}
+		}
+	}
+	b.mtx.Unlock()
+
+	if ready != nil {
+		select {
+		case <-ready:
+		case <-time.After(redisSubscribeTimeout):
+			sub.Close()
+			return nil, errors.New("timeout while subscribing to " + sessionChannel(sessionID))
+		}
+	}
+
+	return sub, nil
+}
+
+// release unsubscribes from a session's channel once its last local
+// subscription has ended.
+func (b *RedisBroker) release(sessionID int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	// somebody might have subscribed again in the meantime.
+	if b.fanout.has(sessionID) {
+		return
+	}
+
+	delete(b.active, sessionID)
+	if b.psc != nil {
+		if err := b.psc.Unsubscribe(sessionChannel(sessionID)); err != nil {
+			xlog.Errorf("RedisBroker: UNSUBSCRIBE failed: %v", err)
+		}
+	}
+}
+
+// receiveLoop maintains the subscriber connection, reconnecting and
+// resubscribing all channels with local subscribers whenever it breaks.
+func (b *RedisBroker) receiveLoop() {
+	backoff := time.Second
+	for {
+		conn, err := redis.Dial("tcp", b.Addr)
+		if err != nil {
+			xlog.Errorf("RedisBroker: redis.Dial failed: %v", err)
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+
+		psc := &redis.PubSubConn{Conn: conn}
+
+		b.mtx.Lock()
+		b.psc = psc
+		channels := []interface{}{}
+		for _, sessionID := range b.fanout.sessions() {
+			channels = append(channels, sessionChannel(sessionID))
+		}
+		if len(channels) > 0 {
+			if err := psc.Subscribe(channels...); err != nil {
+				xlog.Errorf("RedisBroker: resubscribing failed: %v", err)
+			}
+		}
+		b.mtx.Unlock()
+
+		err = b.receive(psc)
+		xlog.Errorf("RedisBroker: subscriber connection failed: %v", err)
+		StatCount("redis subscriber reconnect", 1)
+
+		b.mtx.Lock()
+		b.psc = nil
+		b.active = make(map[int]bool)
+		b.mtx.Unlock()
+
+		conn.Close()
+	}
+}
+
+// receive dispatches everything arriving on the subscriber connection
+// until an error occurs.
+func (b *RedisBroker) receive(psc *redis.PubSubConn) error {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			sessionID, ok := sessionIDFromChannel(v.Channel)
+			if !ok {
+				continue
+			}
+			var cmd Command
+			if err := json.Unmarshal(v.Data, &cmd); err != nil {
+				xlog.Errorf("RedisBroker: decoding message on %s failed: %v", v.Channel, err)
+				continue
+			}
+			b.fanout.publish(sessionID, &cmd)
+		case redis.Subscription:
+			sessionID, ok := sessionIDFromChannel(v.Channel)
+			if !ok {
+				continue
+			}
+			b.mtx.Lock()
+			switch v.Kind {
+			case "subscribe":
+				b.active[sessionID] = true
+				for _, ready := range b.waiting[sessionID] {
+					close(ready)
+				}
+				delete(b.waiting, sessionID)
+			case "unsubscribe":
+				// a new subscription may have been requested after the
+				// unsubscribe was sent; keep it active in that case.
+				if !b.fanout.has(sessionID) {
+					delete(b.active, sessionID)
+				}
+			}
+			b.mtx.Unlock()
+		case error:
+			return v
+		}
+	}
+}
+
+func viewersKey(sessionID int) string {
+	return fmt.Sprintf("viewers.%d", sessionID)
+}
+
+// AddViewer registers a viewer connection with a session.
+func (b *RedisBroker) AddViewer(sessionID int, connID string) error {
+	b.viewers.add(sessionID, connID)
+
+	c := b.pool.Get()
+	defer c.Close()
+
+	return touchViewer(c, sessionID, connID)
+}
+
+// RemoveViewer unregisters a viewer connection from a session.
+func (b *RedisBroker) RemoveViewer(sessionID int, connID string) error {
+	b.viewers.remove(sessionID, connID)
+
+	c := b.pool.Get()
+	defer c.Close()
+
+	_, err := c.Do("ZREM", viewersKey(sessionID), connID)
+	return err
+}
+
+// CountViewers returns the number of viewer connections of a session that
+// have been refreshed recently.
+func (b *RedisBroker) CountViewers(sessionID int) (int, error) {
+	c := b.pool.Get()
+	defer c.Close()
+
+	key := viewersKey(sessionID)
+	if _, err := c.Do("ZREMRANGEBYSCORE", key, "-inf", time.Now().Unix()); err != nil {
+		return 0, err
+	}
+	return redis.Int(c.Do("ZCARD", key))
+}
+
+// touchViewer marks a viewer connection as present for another
+// redisViewerTTL. The whole set expires if no connection is refreshed.
+func touchViewer(c redis.Conn, sessionID int, connID string) error {
+	key := viewersKey(sessionID)
+	if _, err := c.Do("ZADD", key, time.Now().Add(redisViewerTTL).Unix(), connID); err != nil {
+		return err
+	}
+	_, err := c.Do("EXPIRE", key, int(redisViewerTTL/time.Second))
+	return err
+}
+
+// refreshViewers periodically refreshes all viewer connections of this process.
+func (b *RedisBroker) refreshViewers() {
+	for range time.Tick(redisViewerRefreshInterval) {
+		c := b.pool.Get()
+		for sessionID, conns := range b.viewers.all() {
+			for _, connID := range conns {
+				if err := touchViewer(c, sessionID, connID); err != nil {
+					xlog.Errorf("RedisBroker: refreshing viewer %s of session %d failed: %v", connID, sessionID, err)
+				}
+			}
+		}
+		c.Close()
+	}
+}
+
+// reportStats periodically reports the usage of the connection pool and of
+// the subscriber connection.
+func (b *RedisBroker) reportStats() {
+	for range time.Tick(redisStatsInterval) {
+		b.mtx.Lock()
+		channels := len(b.active)
+		b.mtx.Unlock()
+
+		StatValue("redis pool active connections", float64(b.pool.ActiveCount()))
+		StatValue("redis pool max connections", float64(redisMaxActive))
+		StatValue("redis subscribed sessions", float64(channels))
+		StatValue("local subscribers", float64(b.fanout.count()))
+	}
+}
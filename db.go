@@ -2,33 +2,160 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"github.com/joinmytalk/satsuma/pdfmeta"
 	"github.com/joinmytalk/xlog"
 	"github.com/russross/meddler"
 	"strings"
 	"time"
 )
 
-// Store implements the higher-level operations on the data store.
-type Store struct {
+// Store describes the higher-level operations on the data store.
+type Store interface {
+	InsertUpload(u *Upload) error
+	FinishUpload(publicID string, doc *pdfmeta.Document, thumbnails int) error
+	GetUploadByPublicID(publicID string, userID int) (*Upload, error)
+	InsertSession(sess *Session) error
+	DeleteUploadByPublicID(publicID string, userID int) (int64, error)
+	GetUploadsForUser(userID int) ([]*Upload, error)
+	GetPageCount(sessionID int) (int, error)
+	SearchUploads(userID int, terms []string) ([]*SearchResult, error)
+	GetSessions(userID int) ([]*SessionData, error)
+	GetSessionInfoByPublicID(publicID string, userID int) (*SessionInfo, error)
+	GetOwnerForSession(publicID string) (userID int, sessionID int, err error)
+	GetSessionSummary(publicID string) (*SessionSummary, error)
+	StopSession(publicID string, viewers int) error
+	UpdatePeakViewers(sessionID, viewers int) error
+	InsertViewerSample(sample *ViewerSample) error
+	GetViewerSamples(sessionID int) ([]*ViewerSample, error)
+	DeleteSession(publicID string)
+	SetTitleForPresentation(title, publicID string, userID int) error
+	InsertCommand(cmd *Command) error
+	GetSessionSnapshot(sessionID int) (*SessionSnapshot, error)
+	GetCommandsSince(sessionID, seq int) (*SessionResume, error)
+	GetSessionRecording(sessionID int) (*SessionRecording, error)
+	AddPresenter(sessionID int, username string) (*Presenter, error)
+	RemovePresenter(sessionID, userID int) error
+	GetPresenters(sessionID int) ([]*Presenter, error)
+	IsPresenter(sessionID, userID int) (bool, error)
+	GetSessionAccess(sessionID int) (*SessionAccess, error)
+	SetSessionAccess(sessionID int, access *SessionAccess) error
+	IsAllowedViewer(sessionID, userID int) (bool, error)
+	InsertQuestion(q *Question) error
+	UpvoteQuestion(sessionID, questionID int, viewerID string) (*Question, error)
+	SetQuestionState(sessionID, questionID int, state string) (*Question, error)
+	GetQuestions(sessionID int, all bool) ([]*Question, error)
+	InsertPoll(p *Poll) error
+	ClosePoll(sessionID, pollID int) (*Poll, error)
+	VotePoll(sessionID, pollID int, viewerID string, option int) (*Poll, error)
+	GetPolls(sessionID int) ([]*Poll, error)
+	GetSlideNotes(uploadID int) ([]*SlideNote, error)
+	SetSlideNote(note *SlideNote) error
+	SetPublishNotes(sessionID int, publish bool) error
+	GetPublishedNotes(sessionID, page int) (string, error)
+	AddUser(username string, userID int) error
+	CreateUser(username string) (int, error)
+	GetAccountsForUser(userID int) []string
+	GetMergeInfo(username string, userID int) (*MergeInfo, error)
+	RemoveAccounts(userID int, usernames []string) error
+	InsertAPIToken(token *APIToken) error
+	GetAPIToken(tokenHash string) (*APIToken, error)
+	GetAPITokens(userID int) ([]*APIToken, error)
+	TouchAPIToken(tokenID int) error
+	DeleteAPIToken(tokenID, userID int) (int64, error)
+	InsertCredentials(cred *Credentials) error
+	GetCredentials(email string) (*Credentials, error)
+	VerifyCredentials(email string, userID int) (int, error)
+	ResetPassword(email, passwordHash string) error
+	InsertEmailToken(token *EmailToken) error
+	UseEmailToken(tokenHash, purpose string) (email string, err error)
+}
+
+// OpenDB opens a database connection using the specified driver and DSN.
+func OpenDB(driver, dsn string) (*sql.DB, error) {
+	if driver != "mysql" && driver != "sqlite3" {
+		return nil, fmt.Errorf("unsupported database driver %s", driver)
+	}
+
+	sqldb, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == "sqlite3" {
+		if err := prepareSQLite(sqldb); err != nil {
+			sqldb.Close()
+			return nil, err
+		}
+	}
+	return sqldb, nil
+}
+
+// NewStore returns the Store implementation for a database connection
+// of the specified driver.
+func NewStore(driver string, db *sql.DB) Store {
+	if driver == "sqlite3" {
+		return NewSQLiteStore(db)
+	}
+	return NewMySQLStore(db)
+}
+
+// sqlStore implements Store on top of database/sql. The differences between
+// the supported SQL dialects are kept in its fields.
+type sqlStore struct {
 	sqlDB *sql.DB
+	db    *meddler.Database
+
+	// utcNow is the SQL expression that yields the current time in UTC.
+	utcNow string
 }
 
-// NewStore creates a new Store object from a database connection.
-func NewStore(db *sql.DB) *Store {
-	return &Store{sqlDB: db}
+// inTx runs f within a transaction, which is committed if f succeeds and
+// rolled back otherwise.
+func (s *sqlStore) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // InsertUpload inserts an Upload object into the uploads table.
-func (s *Store) InsertUpload(u *Upload) error {
-	return meddler.Insert(s.sqlDB, "uploads", u)
+func (s *sqlStore) InsertUpload(u *Upload) error {
+	return s.db.Insert(s.sqlDB, "uploads", u)
+}
+
+// FinishUpload stores the page metadata and the number of thumbnails of an
+// upload, identified by its publicID, and marks its conversion as finished.
+// doc is nil if the metadata of the upload couldn't be read.
+func (s *sqlStore) FinishUpload(publicID string, doc *pdfmeta.Document, thumbnails int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var uploadID int
+		if err := tx.QueryRow("SELECT id FROM uploads WHERE public_id = ?", publicID).Scan(&uploadID); err != nil {
+			return err
+		}
+		if doc != nil {
+			if err := pdfmeta.Store(tx, uploadID, doc); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("UPDATE uploads SET thumbnails = ?, conversion = 'success' WHERE id = ?", thumbnails, uploadID)
+		return err
+	})
 }
 
 // GetUploadByPublicID returns an Upload object, identified by its
 // publicID and userID.
-func (s *Store) GetUploadByPublicID(publicID string, userID int) (*Upload, error) {
+func (s *sqlStore) GetUploadByPublicID(publicID string, userID int) (*Upload, error) {
 	uploadEntry := &Upload{}
 
-	err := meddler.QueryRow(s.sqlDB, uploadEntry, "select id from uploads where public_id = ? and user_id = ?", publicID, userID)
+	err := s.db.QueryRow(s.sqlDB, uploadEntry, "select id from uploads where public_id = ? and user_id = ?", publicID, userID)
 	if err != nil {
 		uploadEntry = nil
 	}
@@ -36,12 +163,12 @@ func (s *Store) GetUploadByPublicID(publicID string, userID int) (*Upload, error
 }
 
 // InsertSession inserts a Session object into the sessions table.
-func (s *Store) InsertSession(sess *Session) error {
-	return meddler.Insert(s.sqlDB, "sessions", sess)
+func (s *sqlStore) InsertSession(sess *Session) error {
+	return s.db.Insert(s.sqlDB, "sessions", sess)
 }
 
 // DeleteUploadByPublicID deletes an upload, identified by its publicID and its userID.
-func (s *Store) DeleteUploadByPublicID(publicID string, userID int) (int64, error) {
+func (s *sqlStore) DeleteUploadByPublicID(publicID string, userID int) (int64, error) {
 	result, err := s.sqlDB.Exec("DELETE FROM uploads WHERE public_id = ? AND user_id = ?", publicID, userID)
 	if err != nil {
 		return 0, err
@@ -56,24 +183,68 @@ func (s *Store) DeleteUploadByPublicID(publicID string, userID int) (int64, erro
 }
 
 // GetUploadsForUser returns a slice of Upload objects for the specified user.
-func (s *Store) GetUploadsForUser(userID int) ([]*Upload, error) {
+func (s *sqlStore) GetUploadsForUser(userID int) ([]*Upload, error) {
 	result := []*Upload{}
-	err := meddler.QueryAll(s.sqlDB, &result, "SELECT id, title, public_id, user_id, uploaded, conversion FROM uploads WHERE user_id = ?", userID)
+	err := s.db.QueryAll(s.sqlDB, &result, "SELECT id, title, public_id, user_id, uploaded, conversion, pages, thumbnails FROM uploads WHERE user_id = ?", userID)
 	if err != nil {
 		result = nil
 	}
 	return result, err
 }
 
+// SearchUploads returns the uploads of a user, identified by userID, with
+// pages that contain all terms. The uploads are ordered by the number of
+// occurrences of the terms, the pages of each upload likewise.
+func (s *sqlStore) SearchUploads(userID int, terms []string) ([]*SearchResult, error) {
+	if len(terms) == 0 {
+		return []*SearchResult{}, nil
+	}
+
+	args := []interface{}{userID}
+	for _, term := range terms {
+		args = append(args, term)
+	}
+	args = append(args, len(terms))
+
+	var matches []*SearchMatch
+	err := s.db.QueryAll(s.sqlDB, &matches,
+		`SELECT uploads.public_id AS public_id,
+			uploads.title AS title,
+			search_terms.page AS page,
+			SUM(search_terms.occurrences) AS score
+			FROM search_terms, uploads
+			WHERE search_terms.upload_id = uploads.id AND
+				uploads.user_id = ? AND
+				search_terms.term IN (?`+strings.Repeat(", ?", len(terms)-1)+`)
+			GROUP BY uploads.public_id, uploads.title, search_terms.page
+			HAVING COUNT(*) = ?
+			ORDER BY score DESC, search_terms.page`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return rankSearchMatches(matches), nil
+}
+
+// GetPageCount returns the number of pages of the upload presented in a
+// session, identified by its sessionID. It is 0 if the page count is unknown.
+func (s *sqlStore) GetPageCount(sessionID int) (int, error) {
+	var pages int
+	err := s.sqlDB.QueryRow("SELECT uploads.pages FROM uploads, sessions WHERE sessions.upload_id = uploads.id AND sessions.id = ?", sessionID).Scan(&pages)
+	return pages, err
+}
+
 // GetSessions returns a slice of SessionData objects for the specified user.
-func (s *Store) GetSessions(userID int) ([]*SessionData, error) {
+func (s *sqlStore) GetSessions(userID int) ([]*SessionData, error) {
 	xlog.Debugf("GetSessions: userID = %d", userID)
 	result := []*SessionData{}
-	err := meddler.QueryAll(s.sqlDB, &result,
+	err := s.db.QueryAll(s.sqlDB, &result,
 		`SELECT sessions.public_id AS public_id, 
 			sessions.started AS started, 
 			sessions.ended AS ended, 
-			uploads.title AS title
+			uploads.title AS title,
+			uploads.public_id AS upload_id,
+			uploads.thumbnails AS thumbnails
 		FROM uploads, sessions 
 		WHERE sessions.upload_id = uploads.id AND 
 			uploads.user_id = ? 
@@ -94,14 +265,17 @@ func (s *Store) GetSessions(userID int) ([]*SessionData, error) {
 
 // GetSessionInfoByPublicID returns a SessionInfo object for a session, identified
 // by its publicID and userID.
-func (s *Store) GetSessionInfoByPublicID(publicID string, userID int) (*SessionInfo, error) {
+func (s *sqlStore) GetSessionInfoByPublicID(publicID string, userID int) (*SessionInfo, error) {
 	result := &SessionInfo{}
-	err := meddler.QueryRow(s.sqlDB, result,
+	err := s.db.QueryRow(s.sqlDB, result,
 		`SELECT 
 			uploads.title AS title, 
 			uploads.public_id AS public_id, 
 			uploads.user_id AS user_id, 
-			sessions.ended AS ended 
+			sessions.ended AS ended,
+			sessions.visibility AS visibility,
+			sessions.peak_viewers AS peak_viewers,
+			sessions.publish_notes AS publish_notes
 			FROM uploads, sessions 
 			WHERE sessions.upload_id = uploads.id AND
 				sessions.public_id = ?`, publicID)
@@ -114,176 +288,1007 @@ func (s *Store) GetSessionInfoByPublicID(publicID string, userID int) (*SessionI
 		result.EndedJSON = formatted
 	}
 
-	err = meddler.QueryRow(s.sqlDB, &result,
-		`SELECT 
-			commands.page AS page
-			FROM commands, sessions
-			WHERE sessions.id = commands.session_id AND
-				sessions.public_id = ?
-			ORDER BY commands.timestamp DESC LIMIT 1`, publicID)
-	if err != nil {
-		result.Page = 1
-	}
-
 	var cmds []*Command
 
-	err = meddler.QueryAll(s.sqlDB, &cmds,
+	err = s.db.QueryAll(s.sqlDB, &cmds,
 		`SELECT
 			*
 			FROM commands
 			WHERE commands.session_id = (SELECT id FROM sessions WHERE public_id = ?)
-			ORDER BY commands.timestamp`, publicID)
+			ORDER BY commands.seq, commands.id`, publicID)
 	if err != nil {
 		return nil, err
 	}
-	result.Cmds = cmds
+
+	// the commands table holds the complete history, so only deliver what's
+	// still visible.
+	snapshot := buildSnapshot(0, cmds)
+	result.Page = snapshot.Page
+	result.Cmds = snapshot.Drawings()
 	result.IsOwner = (userID != 0 && result.UserID == userID)
+	if userID != 0 && !result.IsOwner {
+		result.IsPresenter, err = s.isPresenterByPublicID(publicID, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// speaker notes are always available to presenters.
+	if result.IsOwner || result.IsPresenter {
+		err = s.db.QueryAll(s.sqlDB, &result.Notes,
+			`SELECT slide_notes.*
+				FROM slide_notes, sessions
+				WHERE slide_notes.upload_id = sessions.upload_id AND
+					sessions.public_id = ?
+				ORDER BY slide_notes.page`, publicID)
+	}
 
 	return result, err
 }
 
+func (s *sqlStore) isPresenterByPublicID(publicID string, userID int) (bool, error) {
+	var count int
+	err := s.sqlDB.QueryRow(`SELECT COUNT(*)
+		FROM session_presenters, sessions
+		WHERE session_presenters.session_id = sessions.id AND
+			sessions.public_id = ? AND
+			session_presenters.user_id = ?`, publicID, userID).Scan(&count)
+	return count > 0, err
+}
+
 // GetOwnerForSession returns the userID and numeric sessionID for a session, identified
 // by its publicID.
-func (s *Store) GetOwnerForSession(publicID string) (userID int, sessionID int, err error) {
+func (s *sqlStore) GetOwnerForSession(publicID string) (userID int, sessionID int, err error) {
 	ownerData := struct {
 		UserID int `meddler:"user_id"`
 		ID     int `meddler:"session_id"`
 	}{}
-	err = meddler.QueryRow(s.sqlDB, &ownerData, "SELECT uploads.user_id AS user_id, sessions.id AS session_id FROM uploads, sessions WHERE sessions.public_id = ? AND sessions.upload_id = uploads.id LIMIT 1", publicID)
+	err = s.db.QueryRow(s.sqlDB, &ownerData, "SELECT uploads.user_id AS user_id, sessions.id AS session_id FROM uploads, sessions WHERE sessions.public_id = ? AND sessions.upload_id = uploads.id LIMIT 1", publicID)
 	return ownerData.UserID, ownerData.ID, err
 }
 
-// StopSession stops a session, identified by its publicID.
-func (s *Store) StopSession(publicID string) {
-	s.sqlDB.Exec("UPDATE sessions SET ended = UTC_TIMESTAMP() WHERE public_id = ?", publicID)
+// GetSessionSummary returns a SessionSummary for a session, identified by its
+// publicID.
+func (s *sqlStore) GetSessionSummary(publicID string) (*SessionSummary, error) {
+	summary := &SessionSummary{}
+	err := s.db.QueryRow(s.sqlDB, summary,
+		`SELECT uploads.title AS title,
+			uploads.public_id AS upload_id,
+			uploads.thumbnails AS thumbnails,
+			sessions.started AS started,
+			sessions.ended AS ended,
+			sessions.visibility AS visibility,
+			COALESCE(upload_pages.width, 0) AS width,
+			COALESCE(upload_pages.height, 0) AS height
+			FROM sessions
+			JOIN uploads ON sessions.upload_id = uploads.id
+			LEFT JOIN upload_pages ON upload_pages.upload_id = uploads.id AND upload_pages.page = 1
+			WHERE sessions.public_id = ?`, publicID)
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// StopSession stops a session, identified by its publicID. viewers is the
+// number of viewers at the end, which becomes the session's peak viewer
+// count if it exceeds it. It returns ErrSessionEnded if the session has
+// already been stopped. The end of a session is recorded in the sessions
+// table only, so it doesn't take a sequence number.
+func (s *sqlStore) StopSession(publicID string, viewers int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE sessions SET ended = "+s.utcNow+" WHERE public_id = ? AND ended IS NULL", publicID)
+		if err != nil {
+			return err
+		}
+
+		if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return ErrSessionEnded
+		}
+
+		_, err = tx.Exec("UPDATE sessions SET peak_viewers = ? WHERE public_id = ? AND peak_viewers < ?", viewers, publicID, viewers)
+		return err
+	})
+}
+
+// UpdatePeakViewers raises the peak viewer count of a session to viewers,
+// unless it's already higher.
+func (s *sqlStore) UpdatePeakViewers(sessionID, viewers int) error {
+	_, err := s.sqlDB.Exec("UPDATE sessions SET peak_viewers = ? WHERE id = ? AND peak_viewers < ?", viewers, sessionID, viewers)
+	return err
+}
+
+// InsertViewerSample inserts a ViewerSample object into the viewer_samples
+// table, unless the session already has a sample taken at the same time.
+// Samplers on different satsuma instances therefore record each point in
+// time only once if they round it the same way.
+func (s *sqlStore) InsertViewerSample(sample *ViewerSample) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM viewer_samples WHERE session_id = ? AND sampled = ?", sample.SessionID, sample.Sampled).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		return s.db.Insert(tx, "viewer_samples", sample)
+	})
+}
+
+// GetViewerSamples returns the viewer counts recorded for a session, oldest first.
+func (s *sqlStore) GetViewerSamples(sessionID int) ([]*ViewerSample, error) {
+	result := []*ViewerSample{}
+	if err := s.db.QueryAll(s.sqlDB, &result, "SELECT * FROM viewer_samples WHERE session_id = ? ORDER BY sampled, id", sessionID); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // DeleteSession deletes a session, identified by its publicID.
-func (s *Store) DeleteSession(publicID string) {
+func (s *sqlStore) DeleteSession(publicID string) {
 	s.sqlDB.Exec("DELETE FROM sessions WHERE public_id = ?", publicID)
 }
 
 // SetTitleForPresentation sets a new title for a presentation, identified
 // by its publicID and userID.
-func (s *Store) SetTitleForPresentation(title, publicID string, userID int) error {
+func (s *sqlStore) SetTitleForPresentation(title, publicID string, userID int) error {
 	_, err := s.sqlDB.Exec("UPDATE uploads SET title = ? WHERE public_id = ? AND user_id = ?", title, publicID, userID)
 	return err
 }
 
-// InsertCommand inserts a Command object into the commands table.
-func (s *Store) InsertCommand(cmd *Command) error {
-	return meddler.Insert(s.sqlDB, "commands", cmd)
+// nextSeq increments the sequence counter of a session and returns the new
+// value. Holding the row lock until the end of tx serializes commands of the
+// same session.
+func nextSeq(tx *sql.Tx, sessionID int) (int, error) {
+	if _, err := tx.Exec("UPDATE sessions SET seq = seq + 1 WHERE id = ?", sessionID); err != nil {
+		return 0, err
+	}
+
+	var seq int
+	err := tx.QueryRow("SELECT seq FROM sessions WHERE id = ?", sessionID).Scan(&seq)
+	return seq, err
 }
 
-// ClearSlide deletes all drawing-related commands for certain page of a session,
-// identified by its sessionID.
-func (s *Store) ClearSlide(sessionID, page int) error {
-	_, err := s.sqlDB.Exec("DELETE FROM commands WHERE session_id = ? AND page = ? AND cmd != 'gotoPage'", sessionID, page)
-	return err
+// InsertCommand assigns the next sequence number of its session to a Command
+// object and inserts it into the commands table. This includes clearSlide
+// commands: the drawing commands they clear stay in the commands table, so
+// that the session can be replayed later on.
+func (s *sqlStore) InsertCommand(cmd *Command) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		seq, err := nextSeq(tx, cmd.SessionID)
+		if err != nil {
+			return err
+		}
+
+		cmd.Seq = seq
+		return s.db.Insert(tx, "commands", cmd)
+	})
 }
 
-// AddUser adds a new account (identified by username) to a user, identified by its
-// userID.
-func (s *Store) AddUser(username string, userID int) error {
+// GetSessionSnapshot returns the current state of a session, identified by
+// its sessionID. The state and its sequence number are read within one
+// transaction, so they are consistent with each other.
+func (s *sqlStore) GetSessionSnapshot(sessionID int) (*SessionSnapshot, error) {
+	var snapshot *SessionSnapshot
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		sessionData := struct {
+			Seq   int       `meddler:"seq"`
+			Ended time.Time `meddler:"ended,utctimez"`
+		}{}
+		if err := s.db.QueryRow(tx, &sessionData, "SELECT seq, ended FROM sessions WHERE id = ?", sessionID); err != nil {
+			return err
+		}
+
+		var cmds []*Command
+		if err := s.db.QueryAll(tx, &cmds, "SELECT * FROM commands WHERE session_id = ? ORDER BY seq, id", sessionID); err != nil {
+			return err
+		}
+
+		snapshot = buildSnapshot(sessionData.Seq, cmds)
+		if !sessionData.Ended.IsZero() {
+			snapshot.Ended = sessionData.Ended.Format(time.RFC3339)
+		}
+
+		var err error
+		snapshot.Notes, err = s.publishedNotes(tx, sessionID, snapshot.Page)
+		return err
+	})
+
+	return snapshot, err
+}
+
+// GetCommandsSince returns all stored commands of a session, identified by its
+// sessionID, with a sequence number higher than seq.
+func (s *sqlStore) GetCommandsSince(sessionID, seq int) (*SessionResume, error) {
+	resume := &SessionResume{Cmd: "resume", Cmds: []*Command{}}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		sessionData := struct {
+			Seq   int       `meddler:"seq"`
+			Ended time.Time `meddler:"ended,utctimez"`
+		}{}
+		if err := s.db.QueryRow(tx, &sessionData, "SELECT seq, ended FROM sessions WHERE id = ?", sessionID); err != nil {
+			return err
+		}
+
+		resume.Seq = sessionData.Seq
+		if !sessionData.Ended.IsZero() {
+			resume.Ended = sessionData.Ended.Format(time.RFC3339)
+		}
+
+		if err := s.db.QueryAll(tx, &resume.Cmds, "SELECT * FROM commands WHERE session_id = ? AND seq > ? ORDER BY seq", sessionID, seq); err != nil {
+			return err
+		}
+
+		for _, cmd := range resume.Cmds {
+			if cmd.Cmd != "gotoPage" {
+				continue
+			}
+			var err error
+			if cmd.Notes, err = s.publishedNotes(tx, sessionID, cmd.Page); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resume, nil
+}
+
+// GetSessionRecording returns the start and end time of a session, identified
+// by its sessionID, together with all its commands.
+func (s *sqlStore) GetSessionRecording(sessionID int) (*SessionRecording, error) {
+	recording := &SessionRecording{}
+	err := s.db.QueryRow(s.sqlDB, recording, "SELECT started, ended, peak_viewers FROM sessions WHERE id = ?", sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.QueryAll(s.sqlDB, &recording.Cmds, "SELECT * FROM commands WHERE session_id = ? ORDER BY seq, id", sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return recording, nil
+}
+
+// AddPresenter makes the user that the account identified by username belongs
+// to a co-presenter of a session, identified by its sessionID. It returns
+// ErrUnknownAccount if nobody ever logged in with that account.
+func (s *sqlStore) AddPresenter(sessionID int, username string) (*Presenter, error) {
 	userData := []*struct {
 		UserID int `meddler:"user_id"`
 	}{}
-	err := meddler.QueryAll(s.sqlDB, &userData, "SELECT user_id FROM accounts WHERE username = ? LIMIT 1", username)
+	if err := s.db.QueryAll(s.sqlDB, &userData, "SELECT user_id FROM accounts WHERE username = ? LIMIT 1", username); err != nil {
+		return nil, err
+	}
+
+	if len(userData) == 0 {
+		return nil, ErrUnknownAccount
+	}
+	userID := userData[0].UserID
+
+	isPresenter, err := s.IsPresenter(sessionID, userID)
 	if err != nil {
-		xlog.Errorf("AddUser: SELECT for username %s failed: %v", username, err)
-		return err
+		return nil, err
 	}
 
-	if len(userData) > 0 {
-		// account already logged in previously, migrate data to this user.
-		if userData[0].UserID == userID {
-			xlog.Debugf("userID is the same, not doing anything.")
-			return nil
+	if !isPresenter {
+		if _, err := s.sqlDB.Exec("INSERT INTO session_presenters (session_id, user_id, added) VALUES (?, ?, "+s.utcNow+")", sessionID, userID); err != nil {
+			return nil, err
 		}
-		xlog.Debugf("AddUser: user exists, migrating data to this user. userID %d -> %d", userData[0].UserID, userID)
+	}
 
-		// first, set account entries to current user.
-		_, err := s.sqlDB.Exec("UPDATE accounts SET user_id = ? WHERE user_id = ?", userID, userData[0].UserID)
-		if err != nil {
-			xlog.Errorf("AddUser: migrating accounts for username %s to userID %d failed: %v", username, userID, err)
+	return &Presenter{UserID: userID, Accounts: s.GetAccountsForUser(userID)}, nil
+}
+
+// RemovePresenter revokes the co-presenter rights of a user for a session.
+func (s *sqlStore) RemovePresenter(sessionID, userID int) error {
+	_, err := s.sqlDB.Exec("DELETE FROM session_presenters WHERE session_id = ? AND user_id = ?", sessionID, userID)
+	return err
+}
+
+// GetPresenters returns the co-presenters of a session, identified by its sessionID.
+func (s *sqlStore) GetPresenters(sessionID int) ([]*Presenter, error) {
+	result := []*Presenter{}
+	err := s.db.QueryAll(s.sqlDB, &result, "SELECT user_id, added FROM session_presenters WHERE session_id = ? ORDER BY added", sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, presenter := range result {
+		presenter.Accounts = s.GetAccountsForUser(presenter.UserID)
+	}
+	return result, nil
+}
+
+// IsPresenter returns whether a user is a co-presenter of a session.
+func (s *sqlStore) IsPresenter(sessionID, userID int) (bool, error) {
+	var count int
+	err := s.sqlDB.QueryRow("SELECT COUNT(*) FROM session_presenters WHERE session_id = ? AND user_id = ?", sessionID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// GetAccountsForUser returns the usernames of all accounts of a user.
+func (s *sqlStore) GetAccountsForUser(userID int) []string {
+	accounts := []*struct {
+		Username string `meddler:"username"`
+	}{}
+
+	if err := s.db.QueryAll(s.sqlDB, &accounts, "SELECT username FROM accounts WHERE user_id = ?", userID); err != nil {
+		xlog.Errorf("Querying usernames for userID %d failed: %v", userID, err)
+		return []string{}
+	}
+
+	usernames := make([]string, 0, len(accounts))
+	for _, acc := range accounts {
+		usernames = append(usernames, acc.Username)
+	}
+	return usernames
+}
+
+// GetSessionAccess returns who may watch a session, identified by its sessionID.
+func (s *sqlStore) GetSessionAccess(sessionID int) (*SessionAccess, error) {
+	access := &SessionAccess{}
+	if err := s.db.QueryRow(s.sqlDB, access, "SELECT visibility, passcode_hash, viewer_token FROM sessions WHERE id = ?", sessionID); err != nil {
+		return nil, err
+	}
+
+	viewers := []*struct {
+		Username string `meddler:"username"`
+	}{}
+	if err := s.db.QueryAll(s.sqlDB, &viewers, "SELECT username FROM session_viewers WHERE session_id = ? ORDER BY username", sessionID); err != nil {
+		return nil, err
+	}
+
+	access.Allowed = make([]string, 0, len(viewers))
+	for _, viewer := range viewers {
+		access.Allowed = append(access.Allowed, viewer.Username)
+	}
+	return access, nil
+}
+
+// SetSessionAccess changes who may watch a session, identified by its
+// sessionID, and replaces its list of allowed accounts.
+func (s *sqlStore) SetSessionAccess(sessionID int, access *SessionAccess) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE sessions SET visibility = ?, passcode_hash = ?, viewer_token = ? WHERE id = ?", access.Visibility, access.PasscodeHash, access.ViewerToken, sessionID); err != nil {
 			return err
 		}
 
-		// then migrate uploads to current user.
-		_, err = s.sqlDB.Exec("UPDATE uploads SET user_id = ? WHERE user_id = ?", userID, userData[0].UserID)
-		if err != nil {
-			xlog.Errorf("AddUser: migrating uploads for username %s to userID %d failed: %v", username, userID, err)
+		if _, err := tx.Exec("DELETE FROM session_viewers WHERE session_id = ?", sessionID); err != nil {
 			return err
 		}
 
-		// finally, delete old user. ON DELETE CASCADE should clean up any old cruft.
-		_, err = s.sqlDB.Exec("DELETE FROM users WHERE id = ?", userData[0].UserID)
+		for _, username := range access.Allowed {
+			if _, err := tx.Exec("INSERT INTO session_viewers (session_id, username) VALUES (?, ?)", sessionID, username); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IsAllowedViewer returns whether any of a user's accounts is on the list of
+// accounts that may watch a session.
+func (s *sqlStore) IsAllowedViewer(sessionID, userID int) (bool, error) {
+	var count int
+	err := s.sqlDB.QueryRow(`SELECT COUNT(*)
+		FROM session_viewers, accounts
+		WHERE session_viewers.username = accounts.username AND
+			session_viewers.session_id = ? AND
+			accounts.user_id = ?`, sessionID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// InsertQuestion inserts a Question object into the questions table.
+func (s *sqlStore) InsertQuestion(q *Question) error {
+	return s.db.Insert(s.sqlDB, "questions", q)
+}
+
+// UpvoteQuestion adds the vote of a viewer to a question of a session and
+// returns the updated question. Every viewer can vote only once for each
+// question; only questions the audience may see can be voted for.
+func (s *sqlStore) UpvoteQuestion(sessionID, questionID int, viewerID string) (*Question, error) {
+	q := &Question{}
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		if err := s.db.QueryRow(tx, q, "SELECT * FROM questions WHERE id = ? AND session_id = ? AND state IN (?, ?)", questionID, sessionID, QuestionApproved, QuestionAnswered); err != nil {
+			return err
+		}
+
+		var voted int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM question_votes WHERE question_id = ? AND viewer_id = ?", questionID, viewerID).Scan(&voted); err != nil {
+			return err
+		}
+		if voted > 0 {
+			return nil
+		}
+
+		if _, err := tx.Exec("INSERT INTO question_votes (question_id, viewer_id) VALUES (?, ?)", questionID, viewerID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE questions SET votes = votes + 1 WHERE id = ?", questionID); err != nil {
+			return err
+		}
+		q.Votes++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// SetQuestionState sets the state of a question of a session and returns the
+// updated question.
+func (s *sqlStore) SetQuestionState(sessionID, questionID int, state string) (*Question, error) {
+	if _, err := s.sqlDB.Exec("UPDATE questions SET state = ? WHERE id = ? AND session_id = ?", state, questionID, sessionID); err != nil {
+		return nil, err
+	}
+
+	q := &Question{}
+	if err := s.db.QueryRow(s.sqlDB, q, "SELECT * FROM questions WHERE id = ? AND session_id = ?", questionID, sessionID); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// GetQuestions returns the questions of a session, the most popular first.
+// Unless all is true, only the questions that the audience may see are
+// included.
+func (s *sqlStore) GetQuestions(sessionID int, all bool) ([]*Question, error) {
+	result := []*Question{}
+	var err error
+	if all {
+		err = s.db.QueryAll(s.sqlDB, &result, "SELECT * FROM questions WHERE session_id = ? ORDER BY votes DESC, asked", sessionID)
 	} else {
-		// account is unknown, simply add new entry to accounts table.
-		_, err := s.sqlDB.Exec("INSERT INTO accounts (username, user_id) VALUES (?, ?)", username, userID)
-		if err != nil {
-			xlog.Errorf("AddUser: INSERT failed: %v", err)
+		err = s.db.QueryAll(s.sqlDB, &result, "SELECT * FROM questions WHERE session_id = ? AND state IN (?, ?) ORDER BY votes DESC, asked", sessionID, QuestionApproved, QuestionAnswered)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// InsertPoll inserts a Poll object into the polls table.
+func (s *sqlStore) InsertPoll(p *Poll) error {
+	if err := s.db.Insert(s.sqlDB, "polls", p); err != nil {
+		return err
+	}
+
+	p.Results = make([]int, len(p.Options))
+	p.Open = true
+	return nil
+}
+
+// ClosePoll closes a poll of a session and returns it with its final results.
+func (s *sqlStore) ClosePoll(sessionID, pollID int) (*Poll, error) {
+	if _, err := s.sqlDB.Exec("UPDATE polls SET closed = "+s.utcNow+" WHERE id = ? AND session_id = ? AND closed IS NULL", pollID, sessionID); err != nil {
+		return nil, err
+	}
+	return s.getPoll(s.sqlDB, sessionID, pollID)
+}
+
+// VotePoll records the vote of a viewer for an option of an open poll and
+// returns the poll with its updated results. Every viewer can vote only once
+// per poll.
+func (s *sqlStore) VotePoll(sessionID, pollID int, viewerID string, option int) (*Poll, error) {
+	var p *Poll
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		var err error
+		if p, err = s.getPoll(tx, sessionID, pollID); err != nil {
 			return err
 		}
+
+		if !p.Open {
+			return ErrPollClosed
+		}
+		if option < 0 || option >= len(p.Options) {
+			return ErrInvalidPollOption
+		}
+
+		var voted int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM poll_votes WHERE poll_id = ? AND viewer_id = ?", pollID, viewerID).Scan(&voted); err != nil {
+			return err
+		}
+		if voted > 0 {
+			return ErrAlreadyVoted
+		}
+
+		if _, err := tx.Exec("INSERT INTO poll_votes (poll_id, viewer_id, option_index, voted) VALUES (?, ?, ?, "+s.utcNow+")", pollID, viewerID, option); err != nil {
+			return err
+		}
+		p.Results[option]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// GetPolls returns all polls of a session with their results, in the order
+// they were started.
+func (s *sqlStore) GetPolls(sessionID int) ([]*Poll, error) {
+	result := []*Poll{}
+	if err := s.db.QueryAll(s.sqlDB, &result, "SELECT * FROM polls WHERE session_id = ? ORDER BY started, id", sessionID); err != nil {
+		return nil, err
+	}
+
+	for _, p := range result {
+		if err := s.loadPollResults(s.sqlDB, p); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *sqlStore) getPoll(db meddler.DB, sessionID, pollID int) (*Poll, error) {
+	p := &Poll{}
+	if err := s.db.QueryRow(db, p, "SELECT * FROM polls WHERE id = ? AND session_id = ?", pollID, sessionID); err != nil {
+		return nil, err
 	}
 
+	if err := s.loadPollResults(db, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// loadPollResults counts the votes for each option of a poll.
+func (s *sqlStore) loadPollResults(db meddler.DB, p *Poll) error {
+	counts := []*struct {
+		Option int `meddler:"option_index"`
+		Votes  int `meddler:"votes"`
+	}{}
+	if err := s.db.QueryAll(db, &counts, "SELECT option_index, COUNT(*) AS votes FROM poll_votes WHERE poll_id = ? GROUP BY option_index", p.ID); err != nil {
+		return err
+	}
+
+	p.Results = make([]int, len(p.Options))
+	for _, count := range counts {
+		if count.Option >= 0 && count.Option < len(p.Results) {
+			p.Results[count.Option] = count.Votes
+		}
+	}
+	p.Open = p.Closed.IsZero()
 	return nil
 }
 
+// GetSlideNotes returns the speaker notes of an upload, identified by its
+// uploadID, ordered by page.
+func (s *sqlStore) GetSlideNotes(uploadID int) ([]*SlideNote, error) {
+	result := []*SlideNote{}
+	err := s.db.QueryAll(s.sqlDB, &result, "SELECT * FROM slide_notes WHERE upload_id = ? ORDER BY page", uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetSlideNote replaces the speaker notes of a page. Empty notes are removed.
+func (s *sqlStore) SetSlideNote(note *SlideNote) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM slide_notes WHERE upload_id = ? AND page = ?", note.UploadID, note.Page); err != nil {
+			return err
+		}
+		if note.Notes == "" {
+			return nil
+		}
+		_, err := tx.Exec("INSERT INTO slide_notes (upload_id, page, notes) VALUES (?, ?, ?)", note.UploadID, note.Page, note.Notes)
+		return err
+	})
+}
+
+// SetPublishNotes sets whether the speaker notes of a session, identified by
+// its sessionID, are delivered to its viewers.
+func (s *sqlStore) SetPublishNotes(sessionID int, publish bool) error {
+	_, err := s.sqlDB.Exec("UPDATE sessions SET publish_notes = ? WHERE id = ?", publish, sessionID)
+	return err
+}
+
+// GetPublishedNotes returns the speaker notes of a page of a session,
+// identified by its sessionID, if the session delivers them to its viewers.
+// Otherwise, it returns an empty string.
+func (s *sqlStore) GetPublishedNotes(sessionID, page int) (string, error) {
+	return s.publishedNotes(s.sqlDB, sessionID, page)
+}
+
+func (s *sqlStore) publishedNotes(db meddler.DB, sessionID, page int) (string, error) {
+	var notes string
+	err := db.QueryRow(`SELECT slide_notes.notes
+		FROM slide_notes, sessions
+		WHERE slide_notes.upload_id = sessions.upload_id AND
+			sessions.id = ? AND
+			sessions.publish_notes AND
+			slide_notes.page = ?`, sessionID, page).Scan(&notes)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return notes, err
+}
+
+// AddUser adds a new account (identified by username) to a user, identified by its
+// userID. If the account already belongs to another user, both users are merged:
+// everything that belongs to the other user is moved to this user, and the other
+// user is deleted. This happens in a single transaction, so that a failure can't
+// leave a partially merged user behind.
+func (s *sqlStore) AddUser(username string, userID int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var oldUserID int
+		err := tx.QueryRow("SELECT user_id FROM accounts WHERE username = ?", username).Scan(&oldUserID)
+		if err == sql.ErrNoRows {
+			// account is unknown, simply add new entry to accounts table.
+			if _, err := tx.Exec("INSERT INTO accounts (username, user_id) VALUES (?, ?)", username, userID); err != nil {
+				xlog.Errorf("AddUser: INSERT failed: %v", err)
+				return err
+			}
+			return nil
+		} else if err != nil {
+			xlog.Errorf("AddUser: SELECT for username %s failed: %v", username, err)
+			return err
+		}
+
+		// account already logged in previously, migrate data to this user.
+		if oldUserID == userID {
+			xlog.Debugf("userID is the same, not doing anything.")
+			return nil
+		}
+		xlog.Debugf("AddUser: user exists, migrating data to this user. userID %d -> %d", oldUserID, userID)
+
+		// record what is merged, so that it can be traced later.
+		if err := s.logMerge(tx, username, oldUserID, userID); err != nil {
+			xlog.Errorf("AddUser: logging merge of username %s to userID %d failed: %v", username, userID, err)
+			return err
+		}
+
+		for _, step := range userMergeSteps(oldUserID, userID) {
+			if _, err := tx.Exec(step.query, step.args...); err != nil {
+				xlog.Errorf("AddUser: migrating %s for username %s to userID %d failed: %v", step.what, username, userID, err)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeStep is a statement that moves data from one user to another.
+type mergeStep struct {
+	what  string
+	query string
+	args  []interface{}
+}
+
+// userMergeSteps returns the statements that move everything that belongs
+// to a user, identified by fromUserID, to another user, and then delete the
+// user. Tables that refer to users, by their ID or by the viewer ID of
+// signed-in viewers, need to be handled here. Rows that would conflict with
+// rows of the other user are dropped.
+func userMergeSteps(fromUserID, toUserID int) []mergeStep {
+	fromViewer, toViewer := fmt.Sprintf("user:%d", fromUserID), fmt.Sprintf("user:%d", toUserID)
+
+	// MySQL doesn't allow a subquery on the table that is modified unless
+	// it is wrapped in a derived table.
+	return []mergeStep{
+		{"accounts", "UPDATE accounts SET user_id = ? WHERE user_id = ?", []interface{}{toUserID, fromUserID}},
+		{"uploads", "UPDATE uploads SET user_id = ? WHERE user_id = ?", []interface{}{toUserID, fromUserID}},
+		{"credentials", "UPDATE credentials SET user_id = ? WHERE user_id = ?", []interface{}{toUserID, fromUserID}},
+		{"credentials", "UPDATE credentials SET pending_user_id = ? WHERE pending_user_id = ?", []interface{}{toUserID, fromUserID}},
+		{"API tokens", "UPDATE api_tokens SET user_id = ? WHERE user_id = ?", []interface{}{toUserID, fromUserID}},
+		{"presenters", `DELETE FROM session_presenters WHERE user_id = ? AND session_id IN
+			(SELECT session_id FROM (SELECT session_id FROM session_presenters WHERE user_id = ?) AS t)`, []interface{}{fromUserID, toUserID}},
+		{"presenters", "UPDATE session_presenters SET user_id = ? WHERE user_id = ?", []interface{}{toUserID, fromUserID}},
+		{"commands", "UPDATE commands SET presenter_id = ? WHERE presenter_id = ?", []interface{}{toUserID, fromUserID}},
+		{"polls", "UPDATE polls SET presenter_id = ? WHERE presenter_id = ?", []interface{}{toUserID, fromUserID}},
+		{"questions", "UPDATE questions SET viewer_id = ? WHERE viewer_id = ?", []interface{}{toViewer, fromViewer}},
+		{"question votes", `UPDATE questions SET votes = votes - 1 WHERE id IN
+			(SELECT question_id FROM question_votes WHERE viewer_id = ? AND question_id IN
+				(SELECT question_id FROM question_votes WHERE viewer_id = ?))`, []interface{}{fromViewer, toViewer}},
+		{"question votes", `DELETE FROM question_votes WHERE viewer_id = ? AND question_id IN
+			(SELECT question_id FROM (SELECT question_id FROM question_votes WHERE viewer_id = ?) AS t)`, []interface{}{fromViewer, toViewer}},
+		{"question votes", "UPDATE question_votes SET viewer_id = ? WHERE viewer_id = ?", []interface{}{toViewer, fromViewer}},
+		{"poll votes", `DELETE FROM poll_votes WHERE viewer_id = ? AND poll_id IN
+			(SELECT poll_id FROM (SELECT poll_id FROM poll_votes WHERE viewer_id = ?) AS t)`, []interface{}{fromViewer, toViewer}},
+		{"poll votes", "UPDATE poll_votes SET viewer_id = ? WHERE viewer_id = ?", []interface{}{toViewer, fromViewer}},
+		// earlier merges into the old user now count as merges into this
+		// user. from_user_id is left alone: it names users that have been
+		// deleted by their merge, which is what the log is there to trace.
+		{"merge log", "UPDATE merge_log SET to_user_id = ? WHERE to_user_id = ?", []interface{}{toUserID, fromUserID}},
+		// finally, delete old user. ON DELETE CASCADE should clean up any old cruft.
+		{"user", "DELETE FROM users WHERE id = ?", []interface{}{fromUserID}},
+	}
+}
+
 // CreateUser checks whether an account for the specified username exists. If it
 // does, then it returns its userID, otherwise it creates a new user and a new
 // account with the specified username and links the account to the user.
-func (s *Store) CreateUser(username string) (int, error) {
-	userData := []*struct {
-		UserID int `meddler:"user_id"`
-	}{}
-	err := meddler.QueryAll(s.sqlDB, &userData, "SELECT user_id FROM accounts WHERE username = ? LIMIT 1", username)
+func (s *sqlStore) CreateUser(username string) (int, error) {
+	var userID int
+	err := s.inTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT user_id FROM accounts WHERE username = ? LIMIT 1", username).Scan(&userID)
+		if err == sql.ErrNoRows {
+			userID, err = newUser(tx, username)
+		}
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
+	return userID, nil
+}
 
-	if len(userData) > 0 {
-		return userData[0].UserID, nil
+// newUser creates a user with a single account, identified by its username,
+// and returns its ID.
+func newUser(tx *sql.Tx, username string) (int, error) {
+	result, err := tx.Exec("INSERT INTO users (id) VALUES(NULL)")
+	if err != nil {
+		return 0, err
 	}
 
-	result, err := s.sqlDB.Exec("INSERT INTO users (id) VALUES(NULL)")
+	userID, err := result.LastInsertId()
 	if err != nil {
 		return 0, err
 	}
 
-	lastInsertID, _ := result.LastInsertId()
+	if _, err := tx.Exec("INSERT INTO accounts (username, user_id) VALUES (?, ?)", username, userID); err != nil {
+		return 0, err
+	}
+	return int(userID), nil
+}
 
-	_, err = s.sqlDB.Exec("INSERT INTO accounts (username, user_id) VALUES (?, ?)", username, lastInsertID)
+// InsertCredentials inserts the credentials of a local account.
+func (s *sqlStore) InsertCredentials(cred *Credentials) error {
+	return s.db.Insert(s.sqlDB, "credentials", cred)
+}
+
+// GetCredentials returns the credentials of a local account, identified by
+// its email address. It returns sql.ErrNoRows if there is no such account.
+func (s *sqlStore) GetCredentials(email string) (*Credentials, error) {
+	cred := &Credentials{}
+	if err := s.db.QueryRow(s.sqlDB, cred, "SELECT * FROM credentials WHERE email = ?", email); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// VerifyCredentials marks the email address of a local account as verified
+// and returns the userID that the account belongs to. Credentials are only
+// bound to a user once their address is verified: the local account is then
+// added to the user identified by userID, or to a new user if userID is 0.
+func (s *sqlStore) VerifyCredentials(email string, userID int) (int, error) {
+	err := s.inTx(func(tx *sql.Tx) error {
+		var boundUserID sql.NullInt64
+		if err := tx.QueryRow("SELECT user_id FROM credentials WHERE email = ?", email).Scan(&boundUserID); err != nil {
+			return err
+		}
+
+		if boundUserID.Valid {
+			userID = int(boundUserID.Int64)
+		} else {
+			var err error
+			if userID, err = bindCredentials(tx, email, userID); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec("UPDATE credentials SET verified = ? WHERE email = ?", true, email)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
+	return userID, nil
+}
+
+// ResetPassword sets the password hash of a local account, identified by its
+// email address, and marks the address as verified. If the address wasn't
+// verified before, whoever registered it may not own it, so the account is
+// detached into a new user first and keeps nothing of what the registration
+// set up.
+func (s *sqlStore) ResetPassword(email, passwordHash string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		cred := &Credentials{}
+		if err := s.db.QueryRow(tx, cred, "SELECT * FROM credentials WHERE email = ?", email); err != nil {
+			return err
+		}
 
-	return int(lastInsertID), nil
+		if !cred.Verified {
+			if _, err := tx.Exec("DELETE FROM accounts WHERE username = ?", localAccountPrefix+email); err != nil {
+				return err
+			}
+			if _, err := bindCredentials(tx, email, 0); err != nil {
+				return err
+			}
+			// credentials that were registered before the address had to be
+			// verified may have left a user without any account behind.
+			if cred.UserID != 0 {
+				if _, err := tx.Exec("DELETE FROM users WHERE id = ? AND id NOT IN (SELECT user_id FROM accounts)", cred.UserID); err != nil {
+					return err
+				}
+			}
+		}
+
+		_, err := tx.Exec("UPDATE credentials SET password_hash = ?, verified = ? WHERE email = ?", passwordHash, true, email)
+		return err
+	})
 }
 
-// GetConnectedSystemsForUser returns a slice of auth service identifiers
-// for which accounts exist that are associated with the specified userID.
-func (s *Store) GetConnectedSystemsForUser(userID int) []string {
-	systemMappings := map[string]string{
-		"google.com":  "gplus",
-		"twitter.com": "twitter",
-		"persona":     "persona",
+// bindCredentials adds the local account of an email address to a user,
+// identified by userID, or to a new user if userID is 0, and binds the
+// credentials of the address to that user. It returns the user's ID.
+func bindCredentials(tx *sql.Tx, email string, userID int) (int, error) {
+	username := localAccountPrefix + email
+	if userID == 0 {
+		var err error
+		if userID, err = newUser(tx, username); err != nil {
+			return 0, err
+		}
+	} else if _, err := tx.Exec("INSERT INTO accounts (username, user_id) VALUES (?, ?)", username, userID); err != nil {
+		return 0, err
 	}
 
-	connectedAccounts := []*struct {
-		Username string `meddler:"username"`
+	if _, err := tx.Exec("UPDATE credentials SET user_id = ?, pending_user_id = NULL WHERE email = ?", userID, email); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// InsertEmailToken inserts a token that has been sent to an email address.
+func (s *sqlStore) InsertEmailToken(token *EmailToken) error {
+	return s.db.Insert(s.sqlDB, "email_tokens", token)
+}
+
+// UseEmailToken looks up an email token, identified by its hash and purpose,
+// and returns the email address that it has been sent to. It invalidates the
+// token and all other tokens for the same address and purpose. It returns
+// ErrInvalidToken if the token is unknown or expired.
+func (s *sqlStore) UseEmailToken(tokenHash, purpose string) (email string, err error) {
+	token := &EmailToken{}
+	err = s.inTx(func(tx *sql.Tx) error {
+		if err := s.db.QueryRow(tx, token, "SELECT * FROM email_tokens WHERE token_hash = ? AND purpose = ?", tokenHash, purpose); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidToken
+			}
+			return err
+		}
+
+		_, err := tx.Exec("DELETE FROM email_tokens WHERE email = ? AND purpose = ?", token.Email, purpose)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if time.Now().After(token.Expires) {
+		return "", ErrInvalidToken
+	}
+	return token.Email, nil
+}
+
+// logMerge records in the merge log that the user of an account, identified
+// by its username, is merged into another user, along with the uploads that
+// are moved.
+func (s *sqlStore) logMerge(tx *sql.Tx, username string, fromUserID, toUserID int) error {
+	uploads := []*struct {
+		ID int `meddler:"id"`
 	}{}
+	if err := s.db.QueryAll(tx, &uploads, "SELECT id FROM uploads WHERE user_id = ?", fromUserID); err != nil {
+		return err
+	}
 
-	if err := meddler.QueryAll(s.sqlDB, &connectedAccounts, "SELECT username FROM accounts WHERE user_id = ?", userID); err != nil {
-		xlog.Errorf("Querying usernames for userID %d failed: %v", userID, err)
-		return []string{}
+	entry := &MergeLogEntry{Merged: time.Now(), Account: username, FromUserID: fromUserID, ToUserID: toUserID}
+	if err := s.db.Insert(tx, "merge_log", entry); err != nil {
+		return err
+	}
+
+	for _, upload := range uploads {
+		if _, err := tx.Exec("INSERT INTO merge_log_uploads (merge_id, upload_id) VALUES (?, ?)", entry.ID, upload.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMergeInfo returns what would be merged into a user, identified by its
+// userID, by adding an account, identified by its username. It returns nil
+// if the account is unknown or already belongs to the user.
+func (s *sqlStore) GetMergeInfo(username string, userID int) (*MergeInfo, error) {
+	info := &MergeInfo{Account: username}
+	err := s.sqlDB.QueryRow("SELECT user_id FROM accounts WHERE username = ?", username).Scan(&info.FromUserID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if info.FromUserID == userID {
+		return nil, nil
+	}
+
+	if err := s.sqlDB.QueryRow("SELECT COUNT(*) FROM uploads WHERE user_id = ?", info.FromUserID).Scan(&info.Uploads); err != nil {
+		return nil, err
 	}
+	return info, nil
+}
 
-	systems := make([]string, 0, len(connectedAccounts))
+// RemoveAccounts removes accounts, identified by their usernames, from a
+// user, along with the credentials of local accounts. It returns
+// ErrLastAccount if the user would be left without any account.
+func (s *sqlStore) RemoveAccounts(userID int, usernames []string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var remaining int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM accounts WHERE user_id = ?", userID).Scan(&remaining); err != nil {
+			return err
+		}
+
+		for _, username := range usernames {
+			result, err := tx.Exec("DELETE FROM accounts WHERE username = ? AND user_id = ?", username, userID)
+			if err != nil {
+				return err
+			}
+			removed, _ := result.RowsAffected()
+			remaining -= int(removed)
+
+			if strings.HasPrefix(username, localAccountPrefix) {
+				email := strings.TrimPrefix(username, localAccountPrefix)
+				if _, err := tx.Exec("DELETE FROM credentials WHERE email = ? AND user_id = ?", email, userID); err != nil {
+					return err
+				}
+			}
+		}
+
+		if remaining < 1 {
+			return ErrLastAccount
+		}
+		return nil
+	})
+}
 
-	for _, acc := range connectedAccounts {
-		systems = append(systems, systemMappings[strings.Split(acc.Username, ":")[0]])
+// InsertAPIToken inserts an APIToken object into the api_tokens table.
+func (s *sqlStore) InsertAPIToken(token *APIToken) error {
+	return s.db.Insert(s.sqlDB, "api_tokens", token)
+}
+
+// GetAPIToken returns an API token, identified by its hash. It returns
+// sql.ErrNoRows if there is no such token.
+func (s *sqlStore) GetAPIToken(tokenHash string) (*APIToken, error) {
+	token := &APIToken{}
+	if err := s.db.QueryRow(s.sqlDB, token, "SELECT * FROM api_tokens WHERE token_hash = ?", tokenHash); err != nil {
+		return nil, err
 	}
+	return token, nil
+}
+
+// GetAPITokens returns the API tokens of a user, identified by its userID.
+func (s *sqlStore) GetAPITokens(userID int) ([]*APIToken, error) {
+	tokens := []*APIToken{}
+	err := s.db.QueryAll(s.sqlDB, &tokens, "SELECT * FROM api_tokens WHERE user_id = ? ORDER BY created", userID)
+	return tokens, err
+}
 
-	return systems
+// TouchAPIToken records that an API token, identified by its tokenID, has
+// been used.
+func (s *sqlStore) TouchAPIToken(tokenID int) error {
+	_, err := s.sqlDB.Exec("UPDATE api_tokens SET last_used = "+s.utcNow+" WHERE id = ?", tokenID)
+	return err
+}
+
+// DeleteAPIToken revokes an API token, identified by its tokenID and the
+// userID of its owner, and returns the number of deleted tokens.
+func (s *sqlStore) DeleteAPIToken(tokenID, userID int) (int64, error) {
+	result, err := s.sqlDB.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", tokenID, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/russross/meddler"
+)
+
+// NewMySQLStore creates a new Store object from a MySQL database connection.
+func NewMySQLStore(db *sql.DB) Store {
+	return &sqlStore{sqlDB: db, db: meddler.MySQL, utcNow: "UTC_TIMESTAMP()"}
+}
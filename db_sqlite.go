@@ -0,0 +1,23 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/russross/meddler"
+)
+
+// prepareSQLite configures a freshly opened SQLite database connection.
+func prepareSQLite(db *sql.DB) error {
+	// SQLite only allows a single writer, and every connection to ":memory:"
+	// would see its own empty database.
+	db.SetMaxOpenConns(1)
+
+	_, err := db.Exec("PRAGMA foreign_keys = ON")
+	return err
+}
+
+// NewSQLiteStore creates a new Store object from a SQLite database connection.
+// Using ":memory:" as DSN gives a throwaway database, e.g. for local development.
+func NewSQLiteStore(db *sql.DB) Store {
+	return &sqlStore{sqlDB: db, db: meddler.SQLite, utcNow: "CURRENT_TIMESTAMP"}
+}
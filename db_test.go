@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/joinmytalk/satsuma/pdfmeta"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStore returns a Store backed by a migrated in-memory SQLite
+// database, and the database itself.
+func newTestStore(t *testing.T) (Store, *sql.DB) {
+	sqldb, err := OpenDB("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := NewMigrator("sqlite3", sqldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return NewStore("sqlite3", sqldb), sqldb
+}
+
+// Users of the merge fixture. The account twitter:from of user mergeFrom is
+// connected to user mergeTo.
+const (
+	mergeTo   = 1
+	mergeFrom = 2
+)
+
+// mergeFixture fills the database with two users that own something in
+// every table that refers to users, with some rows that conflict when the
+// users are merged.
+var mergeFixture = []string{
+	"INSERT INTO users (id) VALUES (1), (2)",
+	"INSERT INTO accounts (username, user_id) VALUES ('google:to', 1), ('twitter:from', 2), ('local:from@example.com', 2)",
+	"INSERT INTO uploads (id, title, public_id, uploaded, user_id) VALUES (1, 'To', 'u1', CURRENT_TIMESTAMP, 1), (2, 'From', 'u2', CURRENT_TIMESTAMP, 2)",
+	"INSERT INTO sessions (id, upload_id, public_id, started) VALUES (1, 1, 's1', CURRENT_TIMESTAMP), (2, 2, 's2', CURRENT_TIMESTAMP)",
+	"INSERT INTO credentials (email, user_id, password_hash, verified, created) VALUES ('from@example.com', 2, 'hash', 1, CURRENT_TIMESTAMP)",
+	"INSERT INTO credentials (email, pending_user_id, password_hash, created) VALUES ('pending@example.com', 2, 'hash', CURRENT_TIMESTAMP)",
+	"INSERT INTO api_tokens (user_id, name, token_hash, scopes, created) VALUES (2, 'script', 'tokenhash', 'uploads', CURRENT_TIMESTAMP)",
+	// both users present session 1.
+	"INSERT INTO session_presenters (session_id, user_id, added) VALUES (1, 2, CURRENT_TIMESTAMP), (1, 1, CURRENT_TIMESTAMP), (2, 2, CURRENT_TIMESTAMP)",
+	"INSERT INTO commands (session_id, cmd, page, timestamp, presenter_id) VALUES (1, 'gotoPage', 2, CURRENT_TIMESTAMP, 2)",
+	"INSERT INTO polls (id, session_id, presenter_id, question, options, started) VALUES (1, 1, 2, 'Which?', '[\"a\",\"b\"]', CURRENT_TIMESTAMP)",
+	// both users voted for question 1 and poll 1.
+	"INSERT INTO questions (id, session_id, viewer_id, text, asked, state, votes) VALUES (1, 1, 'user:2', 'Why?', CURRENT_TIMESTAMP, 'approved', 2), (2, 1, 'anon:x', 'How?', CURRENT_TIMESTAMP, 'approved', 1)",
+	"INSERT INTO question_votes (question_id, viewer_id) VALUES (1, 'user:2'), (1, 'user:1'), (2, 'user:2')",
+	"INSERT INTO poll_votes (poll_id, viewer_id, option_index, voted) VALUES (1, 'user:2', 0, CURRENT_TIMESTAMP), (1, 'user:1', 1, CURRENT_TIMESTAMP)",
+	// user 2 has absorbed user 3 before.
+	"INSERT INTO merge_log (id, merged, account, from_user_id, to_user_id) VALUES (1, CURRENT_TIMESTAMP, 'google:old', 3, 2)",
+}
+
+func newMergeFixture(t *testing.T) (Store, *sql.DB) {
+	dbStore, sqldb := newTestStore(t)
+	for _, stmt := range mergeFixture {
+		if _, err := sqldb.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return dbStore, sqldb
+}
+
+// queryStrings returns the rows of a query, each formatted as a string.
+func queryStrings(t *testing.T, sqldb *sql.DB, query string, args ...interface{}) []string {
+	rows, err := sqldb.Query(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+
+	columns, _ := rows.Columns()
+	result := []string{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			t.Fatal(err)
+		}
+		fields := make([]string, len(values))
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			fields[i] = fmt.Sprint(v)
+		}
+		result = append(result, strings.Join(fields, "|"))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// snapshot returns the content of all tables.
+func snapshot(t *testing.T, sqldb *sql.DB) map[string][]string {
+	tables := make(map[string][]string)
+	for _, table := range queryStrings(t, sqldb, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'") {
+		tables[table] = queryStrings(t, sqldb, "SELECT * FROM "+table)
+		sort.Strings(tables[table])
+	}
+	return tables
+}
+
+func TestFinishUpload(t *testing.T) {
+	dbStore, sqldb := newTestStore(t)
+	defer sqldb.Close()
+
+	if _, err := sqldb.Exec("INSERT INTO users (id) VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"u1", "u2"} {
+		if err := dbStore.InsertUpload(&Upload{Title: id, PublicID: id, UserID: 1, Uploaded: time.Now(), Conversion: "progress"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc := &pdfmeta.Document{Pages: []*pdfmeta.Page{{Number: 1, Width: 720, Height: 540, Text: "Satsuma slides"}}}
+	if err := dbStore.FinishUpload("u1", doc, 1); err != nil {
+		t.Fatalf("FinishUpload failed: %v", err)
+	}
+	// the metadata of u2 couldn't be read.
+	if err := dbStore.FinishUpload("u2", nil, 0); err != nil {
+		t.Fatalf("FinishUpload without metadata failed: %v", err)
+	}
+	if err := dbStore.FinishUpload("unknown", doc, 1); err == nil {
+		t.Errorf("FinishUpload succeeded for an unknown upload")
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT public_id, conversion, pages, thumbnails FROM uploads ORDER BY public_id", []string{"u1|success|1|1", "u2|success|0|0"}},
+		{"SELECT page, text FROM upload_pages", []string{"1|Satsuma slides"}},
+		{"SELECT term FROM search_terms ORDER BY term", []string{"satsuma", "slides"}},
+	}
+
+	for _, test := range tests {
+		if got := queryStrings(t, sqldb, test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestAddUserMerge(t *testing.T) {
+	dbStore, sqldb := newMergeFixture(t)
+	defer sqldb.Close()
+
+	if err := dbStore.AddUser("twitter:from", mergeTo); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT id FROM users", []string{"1"}},
+		{"SELECT username, user_id FROM accounts ORDER BY username", []string{"google:to|1", "local:from@example.com|1", "twitter:from|1"}},
+		{"SELECT id, user_id FROM uploads ORDER BY id", []string{"1|1", "2|1"}},
+		{"SELECT email, user_id, pending_user_id FROM credentials ORDER BY email", []string{"from@example.com|1|<nil>", "pending@example.com|<nil>|1"}},
+		{"SELECT user_id FROM api_tokens", []string{"1"}},
+		{"SELECT session_id, user_id FROM session_presenters ORDER BY session_id", []string{"1|1", "2|1"}},
+		{"SELECT presenter_id FROM commands", []string{"1"}},
+		{"SELECT presenter_id FROM polls", []string{"1"}},
+		{"SELECT id, viewer_id FROM questions ORDER BY id", []string{"1|user:1", "2|anon:x"}},
+		{"SELECT question_id, viewer_id FROM question_votes ORDER BY question_id", []string{"1|user:1", "2|user:1"}},
+		{"SELECT poll_id, viewer_id, option_index FROM poll_votes", []string{"1|user:1|1"}},
+		{"SELECT account, from_user_id, to_user_id FROM merge_log ORDER BY id", []string{"google:old|3|1", "twitter:from|2|1"}},
+		{"SELECT upload_id FROM merge_log_uploads", []string{"2"}},
+	}
+
+	for _, test := range tests {
+		if got := queryStrings(t, sqldb, test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestAddUserMergeVotes(t *testing.T) {
+	dbStore, sqldb := newMergeFixture(t)
+	defer sqldb.Close()
+
+	if err := dbStore.AddUser("twitter:from", mergeTo); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+
+	// the vote count of every question has to match its votes, so that the
+	// merged user can neither vote twice nor lose a vote.
+	inconsistent := queryStrings(t, sqldb, `SELECT id, votes, (SELECT COUNT(*) FROM question_votes WHERE question_id = questions.id)
+		FROM questions WHERE votes != (SELECT COUNT(*) FROM question_votes WHERE question_id = questions.id)`)
+	if len(inconsistent) > 0 {
+		t.Errorf("questions with inconsistent votes (id|votes|actual): %q", inconsistent)
+	}
+
+	if q, err := dbStore.UpvoteQuestion(1, 1, "user:1"); err != nil || q.Votes != 1 {
+		t.Errorf("merged user upvoted a question twice: %v, %v", q, err)
+	}
+	if _, err := dbStore.VotePoll(1, 1, "user:1", 0); err != ErrAlreadyVoted {
+		t.Errorf("merged user voted twice in a poll: %v", err)
+	}
+}
+
+func TestAddUserMergeRollback(t *testing.T) {
+	tests := []struct {
+		name string
+		// inject makes one of the merge steps fail.
+		inject string
+	}{
+		{"first step", "CREATE TRIGGER fail BEFORE UPDATE ON accounts BEGIN SELECT RAISE(ABORT, 'injected'); END"},
+		{"API tokens", "CREATE TRIGGER fail BEFORE UPDATE ON api_tokens BEGIN SELECT RAISE(ABORT, 'injected'); END"},
+		{"question votes", "CREATE TRIGGER fail BEFORE DELETE ON question_votes BEGIN SELECT RAISE(ABORT, 'injected'); END"},
+		{"dropped table", "DROP TABLE poll_votes"},
+		{"merge log", "CREATE TRIGGER fail BEFORE UPDATE ON merge_log BEGIN SELECT RAISE(ABORT, 'injected'); END"},
+		{"user", "CREATE TRIGGER fail BEFORE DELETE ON users BEGIN SELECT RAISE(ABORT, 'injected'); END"},
+	}
+
+	for _, test := range tests {
+		dbStore, sqldb := newMergeFixture(t)
+		if _, err := sqldb.Exec(test.inject); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		before := snapshot(t, sqldb)
+		if err := dbStore.AddUser("twitter:from", mergeTo); err == nil {
+			t.Errorf("%s: AddUser succeeded despite the failing step", test.name)
+		}
+		after := snapshot(t, sqldb)
+
+		for table, rows := range before {
+			if !reflect.DeepEqual(after[table], rows) {
+				t.Errorf("%s: %s changed from %q to %q", test.name, table, rows, after[table])
+			}
+		}
+		if got := queryStrings(t, sqldb, "SELECT id FROM users WHERE id = ?", mergeFrom); len(got) != 1 {
+			t.Errorf("%s: user %d is gone", test.name, mergeFrom)
+		}
+		sqldb.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sseKeepAliveInterval is the interval in which comments are sent to idle
+// event streams, so that proxies don't close them.
+const sseKeepAliveInterval = 30 * time.Second
+
+// EventsHandler delivers the commands of a session as Server-Sent Events,
+// for viewers whose network doesn't allow WebSockets. Every event carries
+// the viewer's sequence number as its ID, so browsers resume through the
+// Last-Event-ID header when they reconnect.
+type EventsHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+	Broker       Broker
+}
+
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	StatCount("event stream", 1)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	publicID := r.URL.Query().Get(":id")
+
+	sessionID, err := authorizeViewer(r, publicID, h.DBStore, h.SessionStore, h.SecureCookie)
+	if err != nil {
+		xlog.Infof("EventsHandler: viewer rejected: %v", err)
+		writeAccessError(w, err)
+		return
+	}
+
+	lastSeq, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	var mtx sync.Mutex
+	send := func(seq int, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		// unsequenced events keep the last event ID.
+		if seq != 0 {
+			if _, err := fmt.Fprintf(w, "id: %d\n", seq); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	defer wg.Wait()
+	defer close(stop)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(sseKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mtx.Lock()
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+				mtx.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	if err := followSession(sessionID, lastSeq, h.DBStore, h.Broker, send, r.Context().Done()); err != nil {
+		xlog.Errorf("EventsHandler: following session %d failed: %v", sessionID, err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+	"github.com/jung-kurt/gofpdf"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+)
+
+// ExportHandler delivers the PDF of a finished session with the final
+// annotations of each page burnt in to the owner and the co-presenters of
+// the session.
+type ExportHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	UploadStore  *FileUploadStore
+}
+
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("export session", 1)
+
+	publicID := r.URL.Query().Get(":id")
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(publicID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !canPresent(h.DBStore, ownerID, sessionID, userID) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	info, err := h.DBStore.GetSessionInfoByPublicID(publicID, userID)
+	if err != nil {
+		xlog.Errorf("Loading session information failed: %v", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if info.EndedJSON == "" {
+		http.Error(w, "session hasn't ended yet", http.StatusConflict)
+		return
+	}
+
+	exportFile := h.UploadStore.PDFPath(info.UploadID)
+	if len(info.Cmds) > 0 {
+		id := generateID()
+		overlayFile := path.Join(h.UploadStore.TmpDir, id+"_overlay.pdf")
+		exportFile = path.Join(h.UploadStore.TmpDir, id+"_export.pdf")
+		defer os.Remove(overlayFile)
+		defer os.Remove(exportFile)
+
+		if err := writeAnnotationOverlay(overlayFile, info.Cmds); err != nil {
+			xlog.Errorf("Writing annotation overlay for session %s failed: %v", publicID, err)
+			http.Error(w, "export failed", http.StatusInternalServerError)
+			return
+		}
+
+		if err := overlayPDF(h.UploadStore.PDFPath(info.UploadID), overlayFile, exportFile); err != nil {
+			xlog.Errorf("Applying annotation overlay for session %s failed: %v", publicID, err)
+			http.Error(w, "export failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	f, err := os.Open(exportFile)
+	if err != nil {
+		xlog.Errorf("Opening %s failed: %v", exportFile, err)
+		http.Error(w, "export failed", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "export failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Title + ".pdf"}))
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// writeAnnotationOverlay creates a PDF file that contains the drawLine
+// commands of each page on a transparent page of the same number. Every
+// overlay page has the size of the canvas the first drawing on it was made
+// on; since the canvas has the aspect ratio of the slide, the overlay page
+// can be scaled onto the slide.
+func writeAnnotationOverlay(filename string, cmds []*Command) error {
+	byPage := make(map[int][]*Command)
+	lastPage := 0
+	for _, cmd := range cmds {
+		if cmd.Cmd != "drawLine" || cmd.CanvasWidth == 0 || cmd.CanvasHeight == 0 {
+			continue
+		}
+		byPage[cmd.Page] = append(byPage[cmd.Page], cmd)
+		if cmd.Page > lastPage {
+			lastPage = cmd.Page
+		}
+	}
+
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{UnitStr: "pt", Size: gofpdf.SizeType{Wd: 1, Ht: 1}})
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetMargins(0, 0, 0)
+
+	for page := 1; page <= lastPage; page++ {
+		drawings := byPage[page]
+		if len(drawings) == 0 {
+			pdf.AddPageFormat("P", gofpdf.SizeType{Wd: 1, Ht: 1})
+			continue
+		}
+
+		width, height := float64(drawings[0].CanvasWidth), float64(drawings[0].CanvasHeight)
+		pdf.AddPageFormat("P", gofpdf.SizeType{Wd: width, Ht: height})
+		pdf.SetAlpha(0.5, "Normal")
+		pdf.SetLineCapStyle("round")
+		pdf.SetLineJoinStyle("round")
+
+		for _, cmd := range drawings {
+			xFactor := width / float64(cmd.CanvasWidth)
+			yFactor := height / float64(cmd.CanvasHeight)
+
+			r, g, b := parseHexColor(cmd.Color)
+			pdf.SetDrawColor(r, g, b)
+			pdf.SetLineWidth(float64(cmd.Width) * xFactor)
+
+			for i := 0; i+1 < len(cmd.Coordinates); i += 2 {
+				x, y := cmd.Coordinates[i]*xFactor, cmd.Coordinates[i+1]*yFactor
+				if i == 0 {
+					pdf.MoveTo(x, y)
+				}
+				pdf.LineTo(x, y)
+			}
+			pdf.DrawPath("D")
+		}
+	}
+
+	return pdf.OutputFileAndClose(filename)
+}
+
+// overlayPDF stamps the pages of overlay onto the pages of src and writes
+// the result to target.
+func overlayPDF(src, overlay, target string) error {
+	output, err := exec.Command("qpdf", src, "--overlay", overlay, "--", target).CombinedOutput()
+	if err != nil {
+		xlog.Errorf("running qpdf failed: %v: %s", err, output)
+		return err
+	}
+	return nil
+}
+
+// parseHexColor parses a color in the #rrggbb notation used by the canvas.
+func parseHexColor(color string) (r, g, b int) {
+	if len(color) != 7 || color[0] != '#' {
+		return 0, 0, 0
+	}
+	value, err := strconv.ParseUint(color[1:], 16, 32)
+	if err != nil {
+		return 0, 0, 0
+	}
+	return int(value >> 16 & 0xff), int(value >> 8 & 0xff), int(value & 0xff)
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/bitly/go-nsq"
+	"github.com/joinmytalk/satsuma/pdfmeta"
+	"github.com/joinmytalk/satsuma/thumbnails"
 	"github.com/joinmytalk/xlog"
 	"io"
 	"net/http"
@@ -11,12 +14,18 @@ import (
 	"path"
 )
 
+// ErrConversionUnavailable is returned by Process for uploads that need to
+// be converted to PDF while there is no nsqd to queue them for pdfd.
+var ErrConversionUnavailable = errors.New("converting uploads to PDF requires pdfd")
+
 // FileUploadStore abstracts the filesystem where files are uploaded to.
+// Without NSQ, PDF uploads are processed in-process, using DBStore.
 type FileUploadStore struct {
 	UploadDir string
 	TmpDir    string
 	NSQ       *nsq.Writer
 	Topic     string
+	DBStore   Store
 }
 
 // ServeHTTP serves HTTP request from the FileUploadStore.
@@ -24,15 +33,16 @@ func (store *FileUploadStore) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	http.ServeFile(w, r, path.Join(store.UploadDir, r.URL.Path))
 }
 
-// Store stores a new file with a specified id in the filesystem. If the
-// file isn't a PDF file, it also attempts a conversion to a PDF file.
-func (store *FileUploadStore) Store(id string, uploadedFile io.Reader, origFileName string) (isPDF bool, err error) {
-	filename := path.Join(store.UploadDir, id+".pdf")
+// Store stores a new file with a specified id in the filesystem and returns
+// the path of the stored file. A PDF file is stored as the upload's PDF file
+// right away, any other file is stored in the TmpDir until it is converted.
+func (store *FileUploadStore) Store(id string, uploadedFile io.Reader, origFileName string) (string, error) {
+	filename := store.PDFPath(id)
 
 	tmpFile := path.Join(store.TmpDir, id+"_"+origFileName)
 	tmpf, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	io.Copy(tmpf, uploadedFile)
@@ -40,42 +50,94 @@ func (store *FileUploadStore) Store(id string, uploadedFile io.Reader, origFileN
 
 	f, err := os.Open(tmpFile)
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	defer f.Close()
 	buf := make([]byte, 4)
 	if _, err = f.Read(buf); err != nil {
-		return false, err
+		os.Remove(tmpFile)
+		return "", err
 	}
 
 	if bytes.Equal(buf, []byte("%PDF")) {
 		xlog.Debugf("%s is a PDF file, renaming to %s", tmpFile, filename)
-		os.Rename(tmpFile, filename)
-		return true, nil
+		if err := os.Rename(tmpFile, filename); err != nil {
+			os.Remove(tmpFile)
+			return "", err
+		}
+		return filename, nil
 	}
-	if err = store.ConvertFileToPDF(id, tmpFile, filename); err != nil {
-		xlog.Errorf("conversion to PDF of %s failed: %v", tmpFile, err)
-		os.Remove(tmpFile)
-		os.Remove(filename)
-		return false, err
-	}
-	return false, nil
+	return tmpFile, nil
+}
+
+// PDFPath returns the path of the PDF file for an upload.
+func (store *FileUploadStore) PDFPath(uploadID string) string {
+	return path.Join(store.UploadDir, uploadID+".pdf")
 }
 
-// Remove removes an uploaded file from the file store.
+// Remove removes an uploaded file and its thumbnails from the file store.
 func (store *FileUploadStore) Remove(uploadID string) {
-	filePath := path.Join(store.UploadDir, uploadID+".pdf")
+	filePath := store.PDFPath(uploadID)
 	xlog.Debugf("FileUploadStore: remove %s", filePath)
 	os.Remove(filePath)
+	os.RemoveAll(thumbnails.Dir(filePath))
+}
+
+// ThumbnailURLs returns the URLs of the page thumbnails and of the preview
+// image of an upload, given the number of its thumbnails.
+func ThumbnailURLs(uploadID string, count int) (thumbs []string, preview string) {
+	thumbs = []string{}
+	if count == 0 {
+		return thumbs, ""
+	}
+	dir := "/userdata/" + path.Base(thumbnails.Dir(uploadID+".pdf"))
+	for page := 1; page <= count; page++ {
+		thumbs = append(thumbs, dir+"/"+thumbnails.Name(page))
+	}
+	return thumbs, dir + "/" + thumbnails.PreviewName
 }
 
-// ConvertFileToPDF attempts to convert a file to PDF.
-func (store *FileUploadStore) ConvertFileToPDF(id, src, target string) error {
-	msg, _ := json.Marshal(map[string]string{"src_file": src, "target_file": target, "upload_id": id})
+// Process queues an upload, stored at src, for pdfd. Unless src already is
+// the upload's PDF file, pdfd converts it to one. Then it reads the PDF
+// file's metadata, renders its thumbnails and marks the conversion of the
+// upload as finished. Without NSQ, PDF uploads are processed in the
+// background instead, and any other upload fails with
+// ErrConversionUnavailable.
+func (store *FileUploadStore) Process(id, src string) error {
+	if store.NSQ == nil {
+		if src != store.PDFPath(id) {
+			return ErrConversionUnavailable
+		}
+		go store.processPDF(id)
+		return nil
+	}
+
+	msg, _ := json.Marshal(map[string]string{"src_file": src, "target_file": store.PDFPath(id), "upload_id": id})
 	if _, _, err := store.NSQ.Publish(store.Topic, msg); err != nil {
 		xlog.Errorf("Queuing message to NSQ %s failed: %v", store.NSQ.Addr, err)
 		return err
 	}
 	return nil
 }
+
+// processPDF does what pdfd does for PDF uploads: it stores the metadata
+// of the PDF file of an upload, renders its thumbnails and marks the
+// conversion of the upload as finished.
+func (store *FileUploadStore) processPDF(id string) {
+	pdfFile := store.PDFPath(id)
+
+	doc, err := pdfmeta.Read(pdfFile)
+	if err != nil {
+		xlog.Errorf("Reading metadata of %s failed: %v", pdfFile, err)
+	}
+	count, err := thumbnails.Render(pdfFile)
+	if err != nil {
+		xlog.Errorf("Rendering thumbnails of %s failed: %v", pdfFile, err)
+	}
+	if err := store.DBStore.FinishUpload(id, doc, count); err != nil {
+		xlog.Errorf("Finishing upload %s failed: %v", id, err)
+		return
+	}
+	xlog.Debugf("Processing of upload %s finished.", id)
+}
@@ -9,7 +9,9 @@ satsumaApp.config(['$routeProvider', '$locationProvider', '$logProvider', functi
 		$routeProvider.when('/tos', { templateUrl: '/assets/partials/tos.html', controller: 'StaticPageCtrl' });
 		$routeProvider.when('/v/:uploadid', { templateUrl: '/assets/partials/pdfviewer.html', controller: 'PDFViewCtrl' });
 		$routeProvider.when('/s/:sessionid', { templateUrl: '/assets/partials/pdfviewer.html', controller: 'PDFViewCtrl' });
+		$routeProvider.when('/e/:sessionid', { templateUrl: '/assets/partials/pdfviewer.html', controller: 'PDFViewCtrl' });
 		$routeProvider.when('/settings', { templateUrl: '/assets/partials/settings.html', controller: 'SettingsCtrl' });
+		$routeProvider.when('/reset', { templateUrl: '/assets/partials/reset.html', controller: 'ResetPasswordCtrl' });
 		$routeProvider.when('/', { templateUrl: '/assets/partials/main.html', controller: 'MainCtrl' });
 
 		$routeProvider.otherwise({ redirectTo: '/' });
@@ -20,7 +22,28 @@ satsumaApp.controller('StaticPageCtrl', [ '$scope', function($scope) {
 	// nothing.
 }]);
 
-satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$location', '$log', '$timeout', function($scope, $routeParams, $http, $location, $log, $timeout) {
+satsumaApp.controller('ResetPasswordCtrl', [ '$scope', '$http', '$location', function($scope, $http, $location) {
+	$scope.reset = { "password": "", "repeat": "" };
+	$scope.done = false;
+	$scope.message = null;
+
+	$scope.resetPassword = function() {
+		if ($scope.reset.password != $scope.reset.repeat) {
+			$scope.message = "The passwords don't match.";
+			return;
+		}
+		$http.post('/auth/local/reset', { 'token': $location.search().token, 'password': $scope.reset.password }).
+		success(function(data, status, headers, config) {
+			$scope.done = true;
+			$scope.message = null;
+		}).
+		error(function(data, status, headers, config) {
+			$scope.message = data;
+		});
+	};
+}]);
+
+satsumaApp.controller('PDFViewCtrl', [ '$scope', '$rootScope', '$routeParams', '$http', '$location', '$log', '$timeout', function($scope, $rootScope, $routeParams, $http, $location, $log, $timeout) {
 	if ($routeParams.uploadid) {
 		$scope.type = "viewer";
 		$scope.id = $routeParams.uploadid;
@@ -30,6 +53,8 @@ satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$loca
 		$scope.type = "session";
 		$scope.rescaleMargin = 220;
 	};
+	// the embedded player (see /oembed) shows nothing but the slides.
+	$rootScope.embedded = ($location.path().indexOf('/e/') == 0);
 	$log.log('PDFViewCtrl: new instance. type = ' + $scope.type);
 
 	$scope.url = window.location.href;
@@ -49,6 +74,13 @@ satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$loca
 	$scope.oldX = $scope.oldY = 0;
 	$scope.cmds = [ ];
 	$scope.ended = null;
+	$scope.questions = [ ];
+	$scope.votedQuestions = { };
+	$scope.polls = [ ];
+	$scope.votedPolls = { };
+	$scope.newPoll = { "question": "", "options": "" };
+	$scope.notes = { };
+	$scope.publishNotes = false;
 
 	$scope.documentProgress = function(progressData) {
 		$log.log(progressData);
@@ -99,7 +131,7 @@ satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$loca
 				function() {
 					for (var i=0;i<$scope.cmds.length;i++) {
 						var cmd = $scope.cmds[i];
-						if (cmd.page == num && cmd.cmd != "gotoPage") {
+						if (cmd.page == num && cmd.cmd == "drawLine") {
 							$scope.executeCommand(cmd);
 						}
 					}
@@ -121,19 +153,20 @@ satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$loca
 			break;
 		case "gotoPage":
 			$scope.pageNum = cmd.page;
+			if (!$scope.presenter) {
+				// viewers only get notes if the session publishes them.
+				$scope.notes[cmd.page] = cmd.notes || "";
+			}
 			$scope.renderPage($scope.pageNum, null);
 			break;
 		case "clearSlide":
-			$scope.cmds = _.reject($scope.cmds, function(cmd) { return cmd.page == $scope.pageNum; });
+			$scope.cmds = _.reject($scope.cmds, function(c) { return c.page == cmd.page; });
 			$scope.renderPage($scope.pageNum, null);
 			break;
 		case "close":
 			$log.log('received close command');
 			$scope.ended = cmd.timestamp;
-			if ($scope.ws) {
-				$scope.ws.close();
-				$scope.ws = null;
-			}
+			$scope.disconnect();
 			$scope.$apply();
 			break;
 		default:
@@ -162,11 +195,19 @@ satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$loca
 	};
 
 	$scope.exit = function() {
+		$scope.disconnect();
+		$location.path('/');
+	};
+
+	$scope.disconnect = function() {
 		if ($scope.ws) {
 			$scope.ws.close();
 			$scope.ws = null;
 		}
-		$location.path('/');
+		if ($scope.es) {
+			$scope.es.close();
+			$scope.es = null;
+		}
 	};
 
 	$scope.clearSlide = function() {
@@ -259,20 +300,232 @@ satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$loca
 		$log.log('WebSocket: onopen for master called');
 		$scope.ws.send(JSON.stringify({"session_id": $scope.sessionId}));
 		$scope.wsSend = true;
+		$scope.loadQuestions();
+		$scope.loadPolls();
+	};
+
+	$scope.onMessageMaster = function(evt) {
+		// commands sent by the other presenters of this session, questions, polls and viewer counts.
+		var data = JSON.parse(evt.data);
+		if (data.cmd == "viewers") {
+			$scope.viewers = data.viewers;
+			$scope.peakViewers = Math.max($scope.peakViewers || 0, data.viewers);
+			$scope.$apply();
+			return;
+		}
+		if (data.cmd == "question") {
+			$scope.updateQuestion(data.question);
+			return;
+		}
+		if (data.cmd == "pollResults") {
+			$scope.updatePoll(data.poll);
+			return;
+		}
+		$scope.executeCommand(data);
+		$scope.cmds.push(data);
 	};
 
 	$scope.openWebSocketSlave = function() {
 		$log.log('WebSocket: onopen for slave called');
-		$scope.ws.send(JSON.stringify({"session_id": $scope.sessionId}));
+		$scope.wsOpened = true;
+		// when reconnecting, only ask for the commands we missed.
+		$scope.ws.send(JSON.stringify({"session_id": $scope.sessionId, "last_seq": $scope.seq || 0}));
+		$scope.loadQuestions();
+		$scope.loadPolls();
 	};
 
 	$scope.onMessageSlave = function(evt) {
 		$log.log('onMessageSlave: received message from server');
 		var data = JSON.parse(evt.data);
+		if (data.cmd == "question") {
+			$scope.updateQuestion(data.question);
+			return;
+		}
+		if (data.cmd == "pollResults") {
+			$scope.updatePoll(data.poll);
+			return;
+		}
+		if (data.cmd == "snapshot") {
+			$scope.applySnapshot(data);
+			return;
+		}
+		if (data.cmd == "resume") {
+			$scope.applyResume(data);
+			return;
+		}
+		if (data.seq) {
+			if ($scope.seq && data.seq != $scope.seq + 1) {
+				// we missed commands, so reconnect to get a fresh snapshot.
+				$log.log('onMessageSlave: expected seq ' + ($scope.seq + 1) + ', got ' + data.seq);
+				$scope.resync();
+				return;
+			}
+			$scope.seq = data.seq;
+		}
 		$scope.executeCommand(data);
 		$scope.cmds.push(data);
 	};
 
+	$scope.applyResume = function(resume) {
+		$log.log('applyResume: ' + resume.cmds.length + ' missed commands, seq = ' + resume.seq);
+		for (var i=0;i<resume.cmds.length;i++) {
+			$scope.executeCommand(resume.cmds[i]);
+			$scope.cmds.push(resume.cmds[i]);
+		}
+		$scope.seq = resume.seq;
+		if (resume.ended) {
+			$scope.executeCommand({"cmd": "close", "timestamp": resume.ended});
+		}
+	};
+
+	$scope.applySnapshot = function(snapshot) {
+		$log.log('applySnapshot: seq = ' + snapshot.seq);
+		$scope.seq = snapshot.seq;
+		$scope.cmds = _.flatten(_.values(snapshot.pages || { }));
+		$scope.pageNum = snapshot.page;
+		$scope.notes[snapshot.page] = snapshot.notes || "";
+		if (snapshot.ended) {
+			$scope.ended = snapshot.ended;
+			$scope.disconnect();
+		}
+		if ($scope.pdfDoc) {
+			$scope.renderPage($scope.pageNum, null);
+		}
+		$scope.$apply();
+	};
+
+	$scope.loadQuestions = function() {
+		$http.get('/api/questions/' + $scope.sessionId).
+		success(function(data, status, header, config) {
+			$scope.questions = data;
+		});
+	};
+
+	$scope.updateQuestion = function(question) {
+		$scope.questions = _.reject($scope.questions, function(q) { return q.id == question.id; });
+		if ($scope.presenter || question.state == "approved" || question.state == "answered") {
+			$scope.questions.push(question);
+		}
+		$scope.questions = _.sortBy($scope.questions, function(q) { return -q.votes; });
+		$scope.$apply();
+	};
+
+	$scope.askQuestion = function() {
+		if ($scope.ws && $scope.newQuestion) {
+			$scope.ws.send(JSON.stringify({"cmd": "askQuestion", "text": $scope.newQuestion}));
+			$scope.newQuestion = "";
+			$scope.questionSent = true;
+		}
+	};
+
+	$scope.upvoteQuestion = function(question) {
+		if ($scope.ws && !$scope.votedQuestions[question.id]) {
+			$scope.ws.send(JSON.stringify({"cmd": "upvoteQuestion", "question_id": question.id}));
+			$scope.votedQuestions[question.id] = true;
+		}
+	};
+
+	$scope.moderateQuestion = function(question, cmd) {
+		if ($scope.wsSend) {
+			$scope.ws.send(JSON.stringify({"cmd": cmd, "question_id": question.id}));
+		}
+	};
+
+	$scope.loadPolls = function() {
+		$http.get('/api/polls/' + $scope.sessionId).
+		success(function(data, status, header, config) {
+			$scope.polls = data;
+		});
+	};
+
+	$scope.updatePoll = function(poll) {
+		var found = false;
+		for (var i=0;i<$scope.polls.length;i++) {
+			if ($scope.polls[i].id == poll.id) {
+				$scope.polls[i] = poll;
+				found = true;
+			}
+		}
+		if (!found) {
+			$scope.polls.push(poll);
+		}
+		$scope.$apply();
+	};
+
+	$scope.pollVotes = function(poll) {
+		return _.reduce(poll.results, function(sum, n) { return sum + n; }, 0);
+	};
+
+	$scope.startPoll = function() {
+		var options = _.filter(_.map($scope.newPoll.options.split("\n"), function(o) { return o.trim(); }), function(o) { return o != ""; });
+		if ($scope.wsSend && $scope.newPoll.question && options.length >= 2) {
+			$scope.ws.send(JSON.stringify({"cmd": "startPoll", "question": $scope.newPoll.question, "options": options}));
+			$scope.newPoll = { "question": "", "options": "" };
+		}
+	};
+
+	$scope.closePoll = function(poll) {
+		if ($scope.wsSend) {
+			$scope.ws.send(JSON.stringify({"cmd": "closePoll", "poll_id": poll.id}));
+		}
+	};
+
+	$scope.votePoll = function(poll, option) {
+		if ($scope.ws && !$scope.votedPolls[poll.id]) {
+			$scope.ws.send(JSON.stringify({"cmd": "votePoll", "poll_id": poll.id, "option": option}));
+			$scope.votedPolls[poll.id] = true;
+		}
+	};
+
+	$scope.saveNotes = function() {
+		var page = $scope.pageNum;
+		$http.put('/api/uploads/' + $scope.id + '/notes/' + page, { "notes": $scope.notes[page] || "" }).
+		success(function(data, status, header, config) {
+			$scope.notesSaved = page;
+		}).
+		error(function(data, status, header, config) {
+			$log.log('saving notes failed: ', status, data);
+		});
+	};
+
+	$scope.togglePublishNotes = function() {
+		$http.post('/api/publishnotes', { "session_id": $scope.sessionId, "publish": !$scope.publishNotes }).
+		success(function(data, status, header, config) {
+			$scope.publishNotes = !$scope.publishNotes;
+		}).
+		error(function(data, status, header, config) {
+			$log.log('changing publishing of notes failed: ', status, data);
+		});
+	};
+
+	$scope.resync = function() {
+		if ($scope.es) {
+			// a new EventSource doesn't send Last-Event-ID, so we get a fresh snapshot.
+			$scope.es.close();
+			$scope.openEventSource();
+		} else if ($scope.ws) {
+			$scope.ws.close();
+		}
+	};
+
+	$scope.onCloseSlave = function(evt) {
+		if (!$scope.wsOpened && window.EventSource) {
+			// WebSockets seem to be blocked on this network, so fall back to Server-Sent Events.
+			$log.log('WebSocket never opened, falling back to EventSource');
+			$scope.ws = null;
+			$scope.openEventSource();
+			return;
+		}
+		$scope.reconnectWebsocketDelayed(evt);
+	};
+
+	$scope.openEventSource = function() {
+		$log.log('Opening EventSource for session ' + $scope.sessionId);
+		// the browser reconnects by itself and resumes from the last event ID.
+		$scope.es = new EventSource('/api/events/' + $scope.sessionId);
+		$scope.es.onmessage = $scope.onMessageSlave;
+	};
+
 	$scope.reconnectWebsocket = function(evt) {
 		if ($scope.ws) {
 			$log.log('reconnecting WebSocket');
@@ -455,20 +708,22 @@ satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$loca
 		$scope.isMouseDown = false;
 	};
 
-	switch ($scope.type) {
-	case "viewer":
-		// TODO: fetch information.
-		$scope.loadPDF("/userdata/" + $scope.id + ".pdf");
-		break;
-	case "session":
+	$scope.loadSession = function() {
 		$http.get('/api/sessioninfo/' + $scope.sessionId).
 		success(function(data, status, header, config) {
 			$log.log('session info: ', data);
+			$scope.passcodeRequired = false;
+			$scope.accessDenied = null;
 			$scope.title = data.title;
 			$scope.id = data.upload_id;
 			$scope.owner = data.owner;
+			$scope.presenter = data.owner || data.presenter;
 			$scope.cmds = data.cmds || [ ];
 			$scope.ended = data.ended;
+			$scope.viewers = data.viewers;
+			$scope.peakViewers = data.peak_viewers;
+			$scope.publishNotes = data.publish_notes;
+			_.each(data.notes || [ ], function(note) { $scope.notes[note.page] = note.notes; });
 			if (data.page) {
 				$scope.pageNum = data.page;
 			}
@@ -477,27 +732,61 @@ satsumaApp.controller('PDFViewCtrl', [ '$scope', '$routeParams', '$http', '$loca
 			$scope.wsURL = proto + "//" + window.location.host + "/api/ws";
 			$log.log('Opening WebSocket to ' + $scope.wsURL);
 			$scope.ws = new WebSocket($scope.wsURL);
-			if ($scope.owner) {
+			if ($scope.presenter) {
 				$scope.bindCanvas();
 				$log.log('setting onopen to openWebSocketMaster');
 				$scope.ws.onopen = $scope.openWebSocketMaster;
+				$scope.ws.onmessage = $scope.onMessageMaster;
+				$scope.ws.onclose = $scope.reconnectWebsocketDelayed;
 			} else {
 				$log.log('setting onmessage to onMessageSlave');
 				$scope.ws.onopen = $scope.openWebSocketSlave;
 				$scope.ws.onmessage = $scope.onMessageSlave;
+				$scope.ws.onclose = $scope.onCloseSlave;
 			}
-			$scope.ws.onclose = $scope.reconnectWebsocketDelayed;
 			$scope.ws.onerror = $scope.logWebsocketError;
+		}).
+		error(function(data, status, header, config) {
+			$log.log('loading session info failed: ', status, data);
+			if (status == 403 && data.visibility == "passcode") {
+				$scope.passcodeRequired = true;
+			} else if (status == 403) {
+				$scope.accessDenied = data.visibility;
+			}
 		});
+	};
+
+	$scope.submitPasscode = function() {
+		$http.post('/api/sessionpasscode', { "session_id": $scope.sessionId, "passcode": $scope.passcode }).
+		success(function(data, status, header, config) {
+			$scope.passcode = "";
+			$scope.loadSession();
+		}).
+		error(function(data, status, header, config) {
+			$scope.wrongPasscode = (status != 429);
+			$scope.passcodeThrottled = (status == 429);
+		});
+	};
+
+	switch ($scope.type) {
+	case "viewer":
+		// TODO: fetch information.
+		if ($routeParams.page) {
+			$scope.pageNum = parseInt($routeParams.page, 10) || 1;
+		}
+		$scope.loadPDF("/userdata/" + $scope.id + ".pdf");
+		break;
+	case "session":
+		$scope.loadSession();
 		break;
 	}
 }]);
 
+
 satsumaApp.controller('LoginCtrl', [ '$scope', '$http', '$rootScope', '$location', '$log', function($scope, $http, $rootScope, $location, $log) {
 	$log.log('LoginCtrl: new instance');
 	$rootScope.checkedLoggedIn = false;
 	$rootScope.loggedIn = false;
-	$scope.personaLoggedIn = false;
 
 	$scope.reload = function() {
 		// this is not really nice because the scope of who's supposed to receive it is very wide, even though
@@ -505,43 +794,53 @@ satsumaApp.controller('LoginCtrl', [ '$scope', '$http', '$rootScope', '$location
 		$rootScope.$broadcast('reload');
 	};
 
-	$scope.signinPersona = function() {
-		$log.log("signinPersona called");
-		navigator.id.request();
-	};
+	$rootScope.oidcProviders = [];
+	$http.get('/api/oidcproviders').
+	success(function(data, status, headers, config) {
+		$rootScope.oidcProviders = data;
+	});
 
-	$scope.signoutPersona = function() {
-		$log.log("signoutPersona called");
-		navigator.id.logout();
-	};
+	$scope.local = { "email": "", "password": "", "register": false };
+	$scope.localMessage = null;
 
-	$scope.onLoginPersona = function(assertion) {
-		if ($scope.loggedIn || $scope.personaLoggedIn) {
-			$log.log("onLoginPersona: already logged in, no need to login again.");
-			return;
-		}
-		$log.log("onLoginPersona called: assertion = ", assertion);
-		$http.post('/auth/persona', { 'assertion': assertion }).
+	$scope.localLogin = function() {
+		$scope.localMessage = null;
+		$http.post('/auth/local/login', { 'email': $scope.local.email, 'password': $scope.local.password }).
 		success(function(data, status, headers, config) {
+			$scope.local.password = "";
 			$rootScope.checkedLoggedIn = true;
-			$rootScope.loggedIn = true;
-			$scope.personaLoggedIn = true;
+			$rootScope.loggedIn = data.logged_in;
 			$log.log('LoginCtrl: loggedIn = ' + $rootScope.loggedIn);
 			$rootScope.$broadcast('loggedIn');
 		}).
-		error(function() {
-			alert('There was an error logging in through Persona, please try again later.');
+		error(function(data, status, headers, config) {
+			$scope.localMessage = data;
 		});
 	};
 
-	$scope.onLogoutPersona = function() {
-		$log.log("onLogoutPersona called");
+	$scope.localRegister = function() {
+		$scope.localMessage = null;
+		$http.post('/auth/local/register', { 'email': $scope.local.email, 'password': $scope.local.password }).
+		success(function(data, status, headers, config) {
+			$scope.local.password = "";
+			$scope.local.register = false;
+			$scope.localMessage = "We sent you an email. Please open the link in it to verify your email address.";
+		}).
+		error(function(data, status, headers, config) {
+			$scope.localMessage = data;
+		});
 	};
 
-	navigator.id.watch({
-		onlogin: $scope.onLoginPersona,
-		onlogout: $scope.onLogoutPersona
-	});
+	$scope.requestPasswordReset = function() {
+		$scope.localMessage = null;
+		$http.post('/auth/local/requestreset', { 'email': $scope.local.email }).
+		success(function(data, status, headers, config) {
+			$scope.localMessage = "If there is an account for " + $scope.local.email + ", we sent an email with a link to reset the password.";
+		}).
+		error(function(data, status, headers, config) {
+			$scope.localMessage = data;
+		});
+	};
 
 	$scope.signOut = function() {
 		$location.path('/');
@@ -553,10 +852,6 @@ satsumaApp.controller('LoginCtrl', [ '$scope', '$http', '$rootScope', '$location
 			$rootScope.loggedIn = false;
 			$log.error('disconnect failed: ' + data);
 		});
-		if ($scope.personaLoggedIn) {
-			$scope.personaLoggedIn = false;
-			$scope.signoutPersona();
-		}
 	};
 
 	$http.get('/api/loggedin').
@@ -579,6 +874,8 @@ satsumaApp.controller('MainCtrl', ['$scope', '$http', '$rootScope', '$log', '$ti
 	$scope.loading_sessions = false;
 	$scope.get_upload_retries = 0;
 	$scope.upload_title = null;
+	$scope.searchQuery = "";
+	$scope.searchResults = null;
 
 	window.signinCallback = function(authData) {
 		$log.log('signinCallback called');
@@ -612,6 +909,20 @@ satsumaApp.controller('MainCtrl', ['$scope', '$http', '$rootScope', '$log', '$ti
 		$scope.getSessions();
 	});
 
+	$scope.searchUploads = function() {
+		if ($scope.searchQuery == "") {
+			$scope.searchResults = null;
+			return;
+		}
+		$http.get('/api/search', { "params": { "q": $scope.searchQuery } }).
+		success(function(data, status, headers, config) {
+			$scope.searchResults = data;
+		}).
+		error(function(data, status, headers, config) {
+			$log.log('search failed: ', status, data);
+		});
+	};
+
 	$scope.getUploads = function() {
 		$scope.loading_uploads = true;
 		$http.get('/api/getuploads').
@@ -774,39 +1085,115 @@ satsumaApp.controller('SettingsCtrl', [ '$scope', '$http', '$log', function($sco
 			$scope.connected = data;
 		});
 	};
-	$scope.personaConnectButtonClicked = false;
-
 	$scope.getConnectedAuthAPIs();
 
-	$scope.connectToPersona = function() {
-		$scope.personaConnectButtonClicked = true;
-		navigator.id.request();
+	$scope.getMerge = function() {
+		$http.get('/api/merge').
+		success(function(data, status, header, config) {
+			$scope.merge = data;
+		});
+	};
+
+	$scope.getMerge();
+
+	$scope.confirmMerge = function(confirm) {
+		$http.post('/api/merge', { 'confirm': confirm }).
+		success(function(data, status, headers, config) {
+			$scope.merge = null;
+			$scope.getConnectedAuthAPIs();
+		}).
+		error(function(data, status, headers, config) {
+			$scope.merge = null;
+			alert('Merging the accounts failed: ' + data);
+		});
+	};
+
+	$scope.unlink = function(system) {
+		$scope.unlinkError = null;
+		$http.post('/api/unlink', { 'system': system }).
+		success(function(data, status, headers, config) {
+			$scope.getConnectedAuthAPIs();
+		}).
+		error(function(data, status, headers, config) {
+			$scope.unlinkError = data;
+		});
+	};
+
+	$scope.localAccount = { "email": "", "password": "" };
+
+	$scope.addLocalAccount = function() {
+		$scope.localAccountMessage = null;
+		$http.post('/auth/local/register', $scope.localAccount).
+		success(function(data, status, headers, config) {
+			$scope.localAccount.password = "";
+			$scope.localAccountMessage = "We sent you an email. Please open the link in it in this browser, while you are signed in, to verify your email address and add it to your account.";
+			$scope.getConnectedAuthAPIs();
+		}).
+		error(function(data, status, headers, config) {
+			$scope.localAccountMessage = data;
+		});
 	};
 
-	$scope.onLoginPersona = function(assertion) {
-		if (!$scope.personaConnectButtonClicked) {
+	$scope.getTokens = function() {
+		$http.get('/api/tokens').
+		success(function(data, status, header, config) {
+			$scope.tokens = data;
+		});
+	};
+
+	$scope.getTokens();
+
+	$scope.newToken = { "name": "", "scopes": { "uploads": true, "sessions": false } };
+
+	$scope.createToken = function() {
+		$scope.tokenMessage = null;
+		$scope.createdToken = null;
+		var scopes = [ ];
+		angular.forEach($scope.newToken.scopes, function(enabled, scope) {
+			if (enabled) {
+				scopes.push(scope);
+			}
+		});
+		$http.post('/api/tokens', { 'name': $scope.newToken.name, 'scopes': scopes }).
+		success(function(data, status, headers, config) {
+			$scope.createdToken = data.token;
+			$scope.newToken.name = "";
+			$scope.getTokens();
+		}).
+		error(function(data, status, headers, config) {
+			$scope.tokenMessage = data;
+		});
+	};
+
+	$scope.revokeToken = function(tokenID) {
+		if (!confirm('Scripts that use this token will stop working. Revoke it?')) {
 			return;
 		}
-		$log.log("Settings: onLoginPersona called: assertion = ", assertion);
-		$http.post('/auth/persona', { 'assertion': assertion }).
+		$http['delete']('/api/tokens/' + tokenID).
 		success(function(data, status, headers, config) {
-			// connecting was successful, now fetch list of connected auth APIs again.
-			$scope.getConnectedAuthAPIs();
-			$scope.personaConnectButtonClicked = false;
+			$scope.getTokens();
 		}).
-		error(function() {
-			alert('There was an error logging in through Persona, please try again later.');
-			$scope.personaConnectButtonClicked = false;
+		error(function(data, status, headers, config) {
+			$scope.tokenMessage = data;
 		});
 	};
 
-	$scope.onLogoutPersona = function() {
-		$log.log("Settings: onLogoutPersona called");
+	$scope.getSessions = function() {
+		$http.get('/api/getsessions').
+		success(function(data, status, header, config) {
+			$scope.sessions = data;
+		});
 	};
 
-	navigator.id.watch({
-		onlogin: $scope.onLoginPersona,
-		onlogout: $scope.onLogoutPersona
-	});
+	$scope.getSessions();
 
+	$scope.showAnalytics = function(sessionId) {
+		$scope.analyticsSession = sessionId;
+		$scope.analytics = null;
+		$http.get('/api/sessions/' + sessionId + '/analytics').
+		success(function(data, status, header, config) {
+			$log.log("Settings: analytics: ", data);
+			$scope.analytics = data;
+		});
+	};
 }]);
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+const (
+	// localAccountPrefix is the prefix of the usernames of local accounts,
+	// followed by the email address.
+	localAccountPrefix = "local:"
+	// maxEmailLength keeps the usernames of local accounts within the 128
+	// characters of accounts.username.
+	maxEmailLength = 128 - len(localAccountPrefix)
+
+	minPasswordLength = 8
+	// bcrypt only looks at the first 72 bytes of a password.
+	maxPasswordLength = 72
+
+	verifyTokenLifetime = 48 * time.Hour
+	resetTokenLifetime  = time.Hour
+)
+
+// Purposes of email tokens.
+const (
+	EmailTokenVerify = "verify"
+	EmailTokenReset  = "reset"
+)
+
+// ErrInvalidToken is returned when an email token is unknown, expired or
+// has already been used.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Credentials are the email address and password of a local account. Until
+// the address is verified, they don't belong to a user: UserID is 0, and
+// PendingUserID is the user that registered them while logged in, if any.
+type Credentials struct {
+	Email         string    `meddler:"email"`
+	UserID        int       `meddler:"user_id,zeroisnull"`
+	PendingUserID int       `meddler:"pending_user_id,zeroisnull"`
+	PasswordHash  string    `meddler:"password_hash"`
+	Verified      bool      `meddler:"verified"`
+	Created       time.Time `meddler:"created,utctimez"`
+}
+
+// EmailToken is a single-use token that is sent to an email address to
+// verify it or to reset the password. Only a hash of the token is stored.
+type EmailToken struct {
+	TokenHash string    `meddler:"token_hash"`
+	Email     string    `meddler:"email"`
+	Purpose   string    `meddler:"purpose"`
+	Expires   time.Time `meddler:"expires,utctimez"`
+}
+
+// dummyPasswordHash is checked against when somebody tries to log in with an
+// unknown email address, so that the response time doesn't tell which
+// addresses are registered.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 1 || at == len(email)-1 || len(email) > maxEmailLength || strings.ContainsAny(email, " \t\r\n<>,;\"") {
+		return "", errors.New("invalid email address")
+	}
+	return email, nil
+}
+
+func checkPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("password is too short")
+	}
+	if len(password) > maxPasswordLength {
+		return errors.New("password is too long")
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// LocalAuth implements accounts that log in with an email address and a
+// password. Their usernames are local:<email>.
+type LocalAuth struct {
+	BaseURL      string
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+	Mailer       Mailer
+}
+
+// sendToken creates an email token and mails a link containing it to
+// email.
+func (a *LocalAuth) sendToken(r *http.Request, email, purpose string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	var (
+		lifetime                      time.Duration
+		link, subject, text, validity string
+	)
+	baseURL := publicBaseURL(a.BaseURL, r)
+	switch purpose {
+	case EmailTokenVerify:
+		lifetime, validity = verifyTokenLifetime, "48 hours"
+		link = baseURL + "/auth/local/verify?token=" + url.QueryEscape(token)
+		subject = "Please verify your email address"
+		text = "please open the following link to verify your email address and sign in to " + siteName
+	case EmailTokenReset:
+		lifetime, validity = resetTokenLifetime, "one hour"
+		link = baseURL + "/reset?token=" + url.QueryEscape(token)
+		subject = "Reset your password"
+		text = "somebody, hopefully you, asked to reset your password on " + siteName + ". Open the following link to choose a new password"
+	}
+
+	err = a.DBStore.InsertEmailToken(&EmailToken{TokenHash: hashToken(token), Email: email, Purpose: purpose, Expires: time.Now().Add(lifetime)})
+	if err != nil {
+		return err
+	}
+
+	body := "Hello,\n\n" + text + ":\n\n" + link + "\n\nThe link is valid for " + validity + ".\n"
+	return a.Mailer.Send(email, subject+" - "+siteName, body)
+}
+
+// localAccount returns the Account for logging in with a local account.
+func localAccount(email string) *Account {
+	return &Account{Username: localAccountPrefix + email, Email: email, Name: email}
+}
+
+// RegisterHandler records the credentials of a local account and sends an
+// email to verify its address. The account is only created once the address
+// is verified, so that nobody can set up an account for an address that
+// isn't theirs. If the user is logged in, the account is added to that user
+// when the same user verifies the address.
+type RegisterHandler struct {
+	Auth *LocalAuth
+}
+
+func (h *RegisterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.Auth.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Errorf("Error fetching session: %v", err)
+		session, _ = h.Auth.SessionStore.New(r, SESSIONNAME)
+	}
+
+	data := struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	email, err := normalizeEmail(data.Email)
+	if err == nil {
+		err = checkPassword(data.Password)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.Auth.DBStore.GetCredentials(email); err == nil {
+		http.Error(w, "email address is already registered", http.StatusConflict)
+		return
+	} else if err != sql.ErrNoRows {
+		xlog.Errorf("Looking up credentials for %s failed: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(data.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cred := &Credentials{Email: email, PasswordHash: string(hash), Created: time.Now()}
+	if userID, ok := session.Values["userID"].(int); ok {
+		if !VerifyXSRFToken(w, r, h.Auth.SessionStore, h.Auth.SecureCookie) {
+			return
+		}
+		cred.PendingUserID = userID
+	}
+
+	if err := h.Auth.DBStore.InsertCredentials(cred); err != nil {
+		xlog.Errorf("Inserting credentials for %s failed: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	StatCount("local register", 1)
+
+	if err := h.Auth.sendToken(r, email, EmailTokenVerify); err != nil {
+		xlog.Errorf("Sending verification email to %s failed: %v", email, err)
+		http.Error(w, "sending verification email failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// VerifyEmailHandler handles the links in verification emails. It marks the
+// email address as verified and logs the user in, unless somebody is
+// already logged in. The account of a newly verified address is added to
+// the user that registered it only if that user is the one logged in now;
+// otherwise, it gets a new user.
+type VerifyEmailHandler struct {
+	Auth *LocalAuth
+}
+
+func (h *VerifyEmailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	email, err := h.Auth.DBStore.UseEmailToken(hashToken(r.URL.Query().Get("token")), EmailTokenVerify)
+	if err != nil {
+		xlog.Infof("Verifying email address failed: %v", err)
+		http.Error(w, ErrInvalidToken.Error(), http.StatusForbidden)
+		return
+	}
+
+	session, err := h.Auth.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Errorf("Error fetching session: %v", err)
+		session, _ = h.Auth.SessionStore.New(r, SESSIONNAME)
+	}
+
+	cred, err := h.Auth.DBStore.GetCredentials(email)
+	if err != nil {
+		xlog.Errorf("Looking up credentials for %s failed: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sessionUserID, loggedIn := session.Values["userID"].(int)
+	userID := 0
+	if loggedIn && sessionUserID == cred.PendingUserID {
+		userID = sessionUserID
+	}
+
+	if userID, err = h.Auth.DBStore.VerifyCredentials(email, userID); err != nil {
+		xlog.Errorf("Marking %s as verified failed: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	StatCount("local verify", 1)
+
+	if loggedIn {
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return
+	}
+
+	logIn(w, r, session, userID, localAccount(email), h.Auth.SecureCookie)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// LocalLoginHandler logs in users with their email address and password.
+type LocalLoginHandler struct {
+	Auth *LocalAuth
+}
+
+func (h *LocalLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.Auth.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Errorf("Error fetching session: %v", err)
+		session, _ = h.Auth.SessionStore.New(r, SESSIONNAME)
+	}
+
+	data := struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	email, _ := normalizeEmail(data.Email)
+
+	cred, err := h.Auth.DBStore.GetCredentials(email)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			xlog.Errorf("Looking up credentials for %s failed: %v", email, err)
+		}
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(data.Password))
+		StatCount("local login failed", 1)
+		http.Error(w, "wrong email address or password", http.StatusForbidden)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(cred.PasswordHash), []byte(data.Password)) != nil {
+		StatCount("local login failed", 1)
+		http.Error(w, "wrong email address or password", http.StatusForbidden)
+		return
+	}
+
+	if !cred.Verified {
+		http.Error(w, "email address not verified yet", http.StatusForbidden)
+		return
+	}
+
+	StatCount("local login", 1)
+
+	logIn(w, r, session, cred.UserID, localAccount(email), h.Auth.SecureCookie)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"logged_in": true, "username": localAccountPrefix + email})
+}
+
+// RequestPasswordResetHandler sends an email with a link to reset the
+// password. It succeeds for unknown addresses as well, so that it doesn't
+// tell which addresses are registered.
+type RequestPasswordResetHandler struct {
+	Auth *LocalAuth
+}
+
+func (h *RequestPasswordResetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Email string `json:"email"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	StatCount("local reset request", 1)
+
+	email, err := normalizeEmail(data.Email)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.Auth.DBStore.GetCredentials(email); err == nil {
+		if err := h.Auth.sendToken(r, email, EmailTokenReset); err != nil {
+			xlog.Errorf("Sending password reset email to %s failed: %v", email, err)
+		}
+	} else if err != sql.ErrNoRows {
+		xlog.Errorf("Looking up credentials for %s failed: %v", email, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResetPasswordHandler sets a new password, given a token from a password
+// reset email. As the token proves that the user can read the emails sent
+// to the address, the address is verified as well. An account that wasn't
+// verified before gets a new user, as whoever registered it may not own the
+// address.
+type ResetPasswordHandler struct {
+	Auth *LocalAuth
+}
+
+func (h *ResetPasswordHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := checkPassword(data.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(data.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	email, err := h.Auth.DBStore.UseEmailToken(hashToken(data.Token), EmailTokenReset)
+	if err != nil {
+		xlog.Infof("Resetting password failed: %v", err)
+		http.Error(w, ErrInvalidToken.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := h.Auth.DBStore.ResetPassword(email, string(hash)); err != nil {
+		xlog.Errorf("Setting password for %s failed: %v", email, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	StatCount("local reset", 1)
+
+	w.WriteHeader(http.StatusNoContent)
+}
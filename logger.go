@@ -42,6 +42,13 @@ func (w *LogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return hj.Hijack()
 }
 
+// Flush wraps the Flush function of the underlying http.ResponseWriter, if it has one.
+func (w *LogResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // WriteHeader wraps the WriteHeader function of the underlying http.ResponseWriter
 // and records the response code.
 func (w *LogResponseWriter) WriteHeader(r int) {
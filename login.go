@@ -9,7 +9,21 @@ import (
 	"net/http"
 )
 
-func Connect(w http.ResponseWriter, r *http.Request, u auth.User, sessionStore sessions.Store, secureCookie *securecookie.SecureCookie, dbStore *Store) {
+// Account identifies an account with an external authentication provider.
+// Username is prefixed with an identifier of the provider.
+type Account struct {
+	Username string
+	Email    string
+	Name     string
+}
+
+func Connect(w http.ResponseWriter, r *http.Request, u auth.User, sessionStore sessions.Store, secureCookie *securecookie.SecureCookie, dbStore Store) {
+	connectAccount(w, r, &Account{Username: u.Provider() + ":" + u.Id(), Email: u.Email(), Name: u.Name()}, sessionStore, secureCookie, dbStore)
+}
+
+// connectAccount logs in the user of an account, or connects the account to
+// the user that is already logged in.
+func connectAccount(w http.ResponseWriter, r *http.Request, account *Account, sessionStore sessions.Store, secureCookie *securecookie.SecureCookie, dbStore Store) {
 	StatCount("connect call", 1)
 	session, err := sessionStore.Get(r, SESSIONNAME)
 	if err != nil {
@@ -17,12 +31,29 @@ func Connect(w http.ResponseWriter, r *http.Request, u auth.User, sessionStore s
 		session, _ = sessionStore.New(r, SESSIONNAME)
 	}
 
+	username := account.Username
+
 	if userID, ok := session.Values["userID"].(int); ok {
 		xlog.Debugf("Connect: already logged in (userID = %d), connecting account", userID)
 		// we have a valid session -> connect account to user
-		username := u.Provider() + ":" + u.Id()
+		info, err := dbStore.GetMergeInfo(username, userID)
+		if err != nil {
+			xlog.Errorf("Error getting merge info: %v", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if info != nil && info.Uploads > 0 {
+			// the account belongs to another user whose uploads would
+			// be moved, so let the user confirm that first.
+			xlog.Debugf("Connect: account belongs to userID %d with %d uploads, asking for confirmation", info.FromUserID, info.Uploads)
+			setPendingMerge(w, r, session, username)
+			w.Header().Set("Location", "/settings")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
 
-		err := dbStore.AddUser(username, userID)
+		err = dbStore.AddUser(username, userID)
 		if err != nil {
 			xlog.Errorf("Error adding user: %v", err)
 			http.Error(w, err.Error(), http.StatusForbidden)
@@ -33,7 +64,6 @@ func Connect(w http.ResponseWriter, r *http.Request, u auth.User, sessionStore s
 	} else {
 		xlog.Debugf("Connect: not logged in, actually log in user.")
 		// no valid session -> actually login user
-		username := u.Provider() + ":" + u.Id()
 		xlog.Debugf("Connect: username = %s", username)
 		userID, err := dbStore.CreateUser(username)
 		if err != nil {
@@ -44,23 +74,34 @@ func Connect(w http.ResponseWriter, r *http.Request, u auth.User, sessionStore s
 
 		xlog.Debugf("Connect: userID = %d", userID)
 
-		// set session values
-		session.Values["userID"] = userID
-		session.Values["username"] = username
-		session.Values["email"] = u.Email()
-		session.Values["name"] = u.Name()
-		session.Save(r, w)
-
-		// set XSRF-TOKEN for AngularJS
-		xsrftoken, _ := secureCookie.Encode(XSRFTOKEN, username)
-		http.SetCookie(w, &http.Cookie{Name: XSRFTOKEN, Value: xsrftoken, Path: "/"})
+		logIn(w, r, session, userID, account, secureCookie)
 
 		w.Header().Set("Location", "/")
 	}
 	w.WriteHeader(http.StatusFound)
 }
 
+// logIn stores the user and the account it logged in with in the session.
+func logIn(w http.ResponseWriter, r *http.Request, session *sessions.Session, userID int, account *Account, secureCookie *securecookie.SecureCookie) {
+	// set session values
+	session.Values["userID"] = userID
+	session.Values["username"] = account.Username
+	session.Values["email"] = account.Email
+	session.Values["name"] = account.Name
+	session.Save(r, w)
+
+	// set XSRF-TOKEN for AngularJS
+	xsrftoken, _ := secureCookie.Encode(XSRFTOKEN, account.Username)
+	http.SetCookie(w, &http.Cookie{Name: XSRFTOKEN, Value: xsrftoken, Path: "/"})
+}
+
 func VerifyXSRFToken(w http.ResponseWriter, r *http.Request, sessionStore sessions.Store, secureCookie *securecookie.SecureCookie) bool {
+	// requests with API tokens don't come from browsers, so they can't be
+	// forged by other sites.
+	if requestAPIToken(r) != nil {
+		return true
+	}
+
 	xsrftoken := r.Header.Get(XSRFTOKENHEADER)
 	userID := ""
 
@@ -139,9 +180,18 @@ func (h *LoggedInHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	jsonEncoder.Encode(map[string]interface{}{"logged_in": loggedIn, "username": username})
 }
 
+// connectedSystems maps the prefixes of account usernames to the auth
+// service identifiers used by the frontend.
+var connectedSystems = map[string]string{
+	"google.com":  "gplus",
+	"twitter.com": "twitter",
+	"local":       "local",
+}
+
 type ConnectedHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
+	OIDC         *OIDCLogin
 }
 
 func (h *ConnectedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -154,12 +204,14 @@ func (h *ConnectedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	userID := session.Values["userID"].(int)
 
-	systems := h.DBStore.GetConnectedSystemsForUser(userID)
+	accounts := h.DBStore.GetAccountsForUser(userID)
 
 	jsonData := make(map[string]bool)
 
-	for _, s := range systems {
-		jsonData[s] = true
+	for _, username := range accounts {
+		if system := accountSystem(username, h.OIDC); system != "" {
+			jsonData[system] = true
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/joinmytalk/xlog"
+)
+
+// Mailer sends emails to users.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailer returns a Mailer that delivers through the SMTP server at addr,
+// or a LogMailer if addr is empty.
+func NewMailer(addr, from, username, password string) Mailer {
+	if addr == "" {
+		return &LogMailer{}
+	}
+	return &SMTPMailer{Addr: addr, From: from, Username: username, Password: password}
+}
+
+// SMTPMailer sends emails through an SMTP server. If Username is set, it
+// authenticates with PLAIN, which net/smtp only allows over TLS or to
+// localhost.
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Send sends a plain text email.
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1)
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(msg))
+}
+
+// LogMailer doesn't send emails but logs them, for development setups
+// without an SMTP server.
+type LogMailer struct{}
+
+// Send logs an email.
+func (m *LogMailer) Send(to, subject, body string) error {
+	xlog.Infof("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
@@ -2,12 +2,10 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
-	"database/sql"
 	"github.com/bitly/go-nsq"
 	"github.com/bmizerany/pat"
 	"github.com/bradrydzewski/go.auth"
 	"github.com/fiorix/go-web/autogzip"
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/joinmytalk/xlog"
@@ -24,11 +22,16 @@ const (
 	SESSIONNAME     = "SATSUMA_COOKIE"
 	XSRFTOKEN       = "XSRF-TOKEN"
 	XSRFTOKENHEADER = "X-XSRF-TOKEN"
+	VIEWERID        = "SATSUMA_VIEWER_ID"
 )
 
 func main() {
 	xlog.SetOutput(os.Stdout)
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrateCommand(os.Args[2:]))
+	}
+
 	options := struct {
 		Addr                string `goptions:"-L, --listen, description='Listen address'"`
 		HashKey             string `goptions:"--hashkey, description='Hash key for cookie store and XSRF', obligatory"`
@@ -39,19 +42,31 @@ func main() {
 		TwitterClientKey    string `goptions:"--twitterclientkey, description='Twitter Client Key', obligatory"`
 		TwitterClientSecret string `goptions:"--twitterclientsecret, description='Twitter Client Secret', obligatory"`
 		TwitterAuthURL      string `goptions:"--twitterauthurl, description='Twitter Authentication URL', obligatory"`
-		DSN                 string `goptions:"--dsn, description='MySQL DSN string', obligatory"`
+		DBDriver            string `goptions:"--db-driver, description='Database driver (mysql or sqlite3)'"`
+		DSN                 string `goptions:"--dsn, description='MySQL DSN string or SQLite database file', obligatory"`
+		Migrate             bool   `goptions:"--migrate, description='Apply pending database migrations on startup'"`
 		HtdocsDir           string `goptions:"--htdocs, description='htdocs directory', obligatory"`
 		UploadDir           string `goptions:"--uploaddir, description='Upload directory', obligatory"`
 		TmpDir              string `goptions:"--tmpdir, description='directory for temporary files', obligatory"`
-		RedisAddr           string `goptions:"--redis, description='redis address', obligatory"`
+		Broker              string `goptions:"--broker, description='Broker for session commands (redis or local)'"`
+		RedisAddr           string `goptions:"--redis, description='redis address'"`
 		AccessLog           bool   `goptions:"--accesslog, description='log HTTP requests'"`
 		StatHat             string `goptions:"--stathat, description='Enable StatHat tracking and set user key'"`
 		Topic               string `goptions:"--topic, description='Topic to which uploads shall be published for conversions'"`
 		NSQAddr             string `goptions:"--nsqd, description='address:port of nsqd to publish messages to'"`
-		PersonaAudience     string `goptions:"--persona-audience, description='Persona audience, e.g. http://localhost:8080'"`
+		OIDCConfig          string `goptions:"--oidc-config, description='JSON file configuring OpenID Connect login providers'"`
+		SMTPAddr            string `goptions:"--smtp, description='host:port of the SMTP server for account emails; they are only logged if unset'"`
+		SMTPFrom            string `goptions:"--smtp-from, description='Sender address of account emails'"`
+		SMTPUser            string `goptions:"--smtp-user, description='SMTP username'"`
+		SMTPPassword        string `goptions:"--smtp-password, description='SMTP password'"`
+		TrustedProxies      string `goptions:"--trusted-proxies, description='Comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For header is trusted'"`
+		BaseURL             string `goptions:"--base-url, description='Public base URL for links in shared session previews, login callbacks and emails, e.g. https://joinmytalk.com'"`
 	}{
 		Addr:      "[::]:8080",
+		Broker:    "redis",
 		RedisAddr: ":6379",
+		DBDriver:  "mysql",
+		SMTPFrom:  "noreply@localhost",
 	}
 	goptions.ParseAndFail(&options)
 
@@ -60,24 +75,56 @@ func main() {
 		stathatUserKey = options.StatHat
 	}
 
+	if err := SetTrustedProxies(options.TrustedProxies); err != nil {
+		xlog.Fatalf("Parsing trusted proxies failed: %v", err)
+	}
+
 	xlog.Debug("Creating cookie store...")
-	sessionStore := sessions.NewCookieStore([]byte(options.HashKey), []byte(options.BlockKey))
+	sessionStore := &TokenSessionStore{Store: sessions.NewCookieStore([]byte(options.HashKey), []byte(options.BlockKey))}
 	secureCookie := securecookie.New([]byte(options.HashKey), []byte(options.BlockKey))
 
 	auth.Config.CookieSecret = []byte(options.HashKey)
 	auth.Config.LoginSuccessRedirect = "/api/connect"
 	auth.Config.CookieSecure = false
 
-	xlog.Debugf("Connecting to database %s...", options.DSN)
+	xlog.Debugf("Connecting to %s database %s...", options.DBDriver, options.DSN)
 
-	var dbStore *Store
-	if sqldb, err := sql.Open("mysql", options.DSN); err != nil {
-		xlog.Fatalf("sql.Open failed: %v", err)
-	} else {
-		dbStore = NewStore(sqldb)
+	sqldb, err := OpenDB(options.DBDriver, options.DSN)
+	if err != nil {
+		xlog.Fatalf("Opening database failed: %v", err)
+	}
+
+	migrator, err := NewMigrator(options.DBDriver, sqldb)
+	if err != nil {
+		xlog.Fatalf("Loading migrations failed: %v", err)
+	}
+
+	if options.Migrate {
+		if err := migrator.Up(); err != nil {
+			xlog.Fatalf("Applying migrations failed: %v", err)
+		}
+	}
+
+	if err := migrator.Check(); err != nil {
+		xlog.Fatalf("%v (run \"satsuma migrate up\" or start with --migrate)", err)
 	}
 
-	fileStore := &FileUploadStore{UploadDir: options.UploadDir, TmpDir: options.TmpDir, Topic: options.Topic, NSQ: nsq.NewWriter(options.NSQAddr)}
+	dbStore := NewStore(options.DBDriver, sqldb)
+
+	broker, err := NewBroker(options.Broker, options.RedisAddr)
+	if err != nil {
+		xlog.Fatalf("Creating broker failed: %v", err)
+	}
+
+	sampler := NewViewerSampler(dbStore, broker)
+	go sampler.Run()
+
+	fileStore := &FileUploadStore{UploadDir: options.UploadDir, TmpDir: options.TmpDir, DBStore: dbStore}
+	if options.NSQAddr != "" && options.Topic != "" {
+		fileStore.NSQ, fileStore.Topic = nsq.NewWriter(options.NSQAddr), options.Topic
+	} else {
+		xlog.Infof("No nsqd or topic configured, only PDF files can be uploaded.")
+	}
 
 	xlog.Debugf("Creating upload directory %s...", options.UploadDir)
 	os.Mkdir(options.UploadDir, 0755)
@@ -90,28 +137,83 @@ func main() {
 	// auth calls
 	mux.Handle("/auth/gplus", auth.Google(options.GplusClientID, options.GplusClientSecret, options.GPlusAuthURL))
 	mux.Handle("/auth/twitter", auth.Twitter(options.TwitterClientKey, options.TwitterClientSecret, options.TwitterAuthURL))
-	mux.Handle("/auth/persona", &PersonaAuthHandler{Audience: options.PersonaAudience, SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
 
-	// API calls.
+	oidcConfig := &OIDCConfig{}
+	if options.OIDCConfig != "" {
+		if oidcConfig, err = LoadOIDCConfig(options.OIDCConfig); err != nil {
+			xlog.Fatalf("Loading OpenID Connect configuration failed: %v", err)
+		}
+	}
+	oidcLogin := NewOIDCLogin(oidcConfig, options.BaseURL, sessionStore, dbStore, secureCookie)
+
+	oidcRouter := pat.New()
+	oidcRouter.Get("/auth/oidc/:provider", &OIDCStartHandler{Login: oidcLogin})
+	oidcRouter.Get("/auth/oidc/:provider/callback", &OIDCCallbackHandler{Login: oidcLogin})
+	mux.Handle("/auth/oidc/", oidcRouter)
+
+	localAuth := &LocalAuth{BaseURL: options.BaseURL, SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie,
+		Mailer: NewMailer(options.SMTPAddr, options.SMTPFrom, options.SMTPUser, options.SMTPPassword)}
+	localRouter := pat.New()
+	localRouter.Post("/auth/local/register", &RegisterHandler{Auth: localAuth})
+	localRouter.Get("/auth/local/verify", &VerifyEmailHandler{Auth: localAuth})
+	localRouter.Post("/auth/local/login", &LocalLoginHandler{Auth: localAuth})
+	localRouter.Post("/auth/local/requestreset", &RequestPasswordResetHandler{Auth: localAuth})
+	localRouter.Post("/auth/local/reset", &ResetPasswordHandler{Auth: localAuth})
+	mux.Handle("/auth/local/", localRouter)
+
+	// API calls. Those that scripts may use accept API tokens.
+	tokenAuth := &APITokenAuth{DBStore: dbStore}
 	apiRouter := pat.New()
 	apiRouter.Get("/api/loggedin", &LoggedInHandler{SessionStore: sessionStore})
 	apiRouter.Get("/api/connect", http.HandlerFunc(auth.SecureUser(func(w http.ResponseWriter, r *http.Request, u auth.User) {
 		Connect(w, r, u, sessionStore, secureCookie, dbStore)
 	})))
-	apiRouter.Get("/api/connected", &ConnectedHandler{SessionStore: sessionStore, DBStore: dbStore})
+	apiRouter.Get("/api/connected", &ConnectedHandler{SessionStore: sessionStore, DBStore: dbStore, OIDC: oidcLogin})
+	apiRouter.Get("/api/oidcproviders", &OIDCProvidersHandler{Login: oidcLogin})
 	apiRouter.Post("/api/disconnect", &DisconnectHandler{SessionStore: sessionStore, SecureCookie: secureCookie})
-	apiRouter.Post("/api/upload", &UploadHandler{SessionStore: sessionStore, DBStore: dbStore, UploadStore: fileStore, SecureCookie: secureCookie})
-	apiRouter.Get("/api/getuploads", &GetUploadsHandler{SessionStore: sessionStore, DBStore: dbStore})
-	apiRouter.Post("/api/renameupload", &RenameUploadHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
-	apiRouter.Post("/api/delupload", &DeleteUploadHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie, UploadStore: fileStore})
-	apiRouter.Post("/api/startsession", &StartSessionHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
-	apiRouter.Post("/api/stopsession", &StopSessionHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie, RedisAddr: options.RedisAddr})
-	apiRouter.Post("/api/delsession", &DeleteSessionHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
-	apiRouter.Get("/api/getsessions", &GetSessionsHandler{SessionStore: sessionStore, DBStore: dbStore})
-	apiRouter.Get("/api/sessioninfo/:id", &GetSessionInfoHandler{SessionStore: sessionStore, DBStore: dbStore})
+	apiRouter.Post("/api/unlink", &UnlinkHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie, OIDC: oidcLogin})
+	apiRouter.Get("/api/merge", &MergeHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
+	apiRouter.Post("/api/merge", &MergeHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
+	apiRouter.Get("/api/tokens", &APITokensHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
+	apiRouter.Post("/api/tokens", &APITokensHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
+	apiRouter.Del("/api/tokens/:id", &RevokeAPITokenHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie})
+	apiRouter.Post("/api/upload", tokenAuth.Require(ScopeUploads, &UploadHandler{SessionStore: sessionStore, DBStore: dbStore, UploadStore: fileStore, SecureCookie: secureCookie}))
+	apiRouter.Get("/api/getuploads", tokenAuth.Require(ScopeUploads, &GetUploadsHandler{SessionStore: sessionStore, DBStore: dbStore}))
+	apiRouter.Get("/api/search", tokenAuth.Require(ScopeUploads, &SearchHandler{SessionStore: sessionStore, DBStore: dbStore}))
+	apiRouter.Post("/api/renameupload", tokenAuth.Require(ScopeUploads, &RenameUploadHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Post("/api/delupload", tokenAuth.Require(ScopeUploads, &DeleteUploadHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie, UploadStore: fileStore}))
+	apiRouter.Get("/api/uploads/:id/notes", tokenAuth.Require(ScopeUploads, &GetSlideNotesHandler{SessionStore: sessionStore, DBStore: dbStore}))
+	apiRouter.Put("/api/uploads/:id/notes/:page", tokenAuth.Require(ScopeUploads, &SetSlideNoteHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Del("/api/uploads/:id/notes/:page", tokenAuth.Require(ScopeUploads, &DeleteSlideNoteHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Post("/api/startsession", tokenAuth.Require(ScopeSessions, &StartSessionHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Post("/api/stopsession", tokenAuth.Require(ScopeSessions, &StopSessionHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie, Broker: broker}))
+	apiRouter.Post("/api/delsession", tokenAuth.Require(ScopeSessions, &DeleteSessionHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Get("/api/getsessions", tokenAuth.Require(ScopeSessions, &GetSessionsHandler{SessionStore: sessionStore, DBStore: dbStore}))
+	apiRouter.Post("/api/addpresenter", tokenAuth.Require(ScopeSessions, &AddPresenterHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Post("/api/delpresenter", tokenAuth.Require(ScopeSessions, &DeletePresenterHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Get("/api/presenters/:id", tokenAuth.Require(ScopeSessions, &GetPresentersHandler{SessionStore: sessionStore, DBStore: dbStore}))
+	apiRouter.Get("/api/sessioninfo/:id", &GetSessionInfoHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie, Broker: broker})
+	apiRouter.Post("/api/sessionpasscode", NewSessionPasscodeHandler(dbStore, secureCookie))
+	apiRouter.Get("/api/sessionaccess/:id", tokenAuth.Require(ScopeSessions, &GetSessionAccessHandler{SessionStore: sessionStore, DBStore: dbStore}))
+	apiRouter.Post("/api/sessionaccess", tokenAuth.Require(ScopeSessions, &SetSessionAccessHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Post("/api/publishnotes", tokenAuth.Require(ScopeSessions, &PublishNotesHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Get("/api/questions/:id", tokenAuth.Require(ScopeSessions, &GetQuestionsHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Get("/api/polls/:id", tokenAuth.Require(ScopeSessions, &GetPollsHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}))
+	apiRouter.Get("/api/export/:id/polls.csv", tokenAuth.Require(ScopeSessions, &ExportPollsHandler{SessionStore: sessionStore, DBStore: dbStore}))
+	apiRouter.Get("/api/sessions/:id/analytics", tokenAuth.Require(ScopeSessions, &AnalyticsHandler{SessionStore: sessionStore, DBStore: dbStore}))
+	apiRouter.Get("/api/sessions/:id/analytics.csv", tokenAuth.Require(ScopeSessions, &AnalyticsHandler{SessionStore: sessionStore, DBStore: dbStore, CSV: true}))
+	apiRouter.Get("/api/export/:id.pdf", tokenAuth.Require(ScopeSessions, &ExportHandler{SessionStore: sessionStore, DBStore: dbStore, UploadStore: fileStore}))
 	mux.Handle("/api/ws", websocket.Handler(func(c *websocket.Conn) {
-		WebsocketHandler(c, dbStore, sessionStore, options.RedisAddr)
+		WebsocketHandler(c, dbStore, sessionStore, secureCookie, broker, sampler)
+	}))
+	mux.Handle("/api/replay/", websocket.Handler(func(c *websocket.Conn) {
+		ReplayHandler(c, dbStore, sessionStore, secureCookie)
 	}))
+	// event streams must be flushed immediately, so they can't go through autogzip.
+	eventsRouter := pat.New()
+	eventsRouter.Get("/api/events/:id", &EventsHandler{SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie, Broker: broker})
+	mux.Handle("/api/events/", eventsRouter)
+
 	// let all API things go through autogzip.
 	mux.Handle("/api/", autogzip.Handle(apiRouter))
 
@@ -120,9 +222,13 @@ func main() {
 		http.ServeFile(w, r, path.Join(options.HtdocsDir, "index.html"))
 	})
 
-	// deliver index.html for AngularJS routes.
+	// deliver index.html for AngularJS routes. Session pages contain
+	// metadata for link previews.
+	sessionPage := autogzip.Handle(&SessionPageHandler{DBStore: dbStore, HtdocsDir: options.HtdocsDir, BaseURL: options.BaseURL})
 	mux.HandleFunc("/v/", deliverIndex)
-	mux.HandleFunc("/s/", deliverIndex)
+	mux.Handle("/s/", sessionPage)
+	mux.Handle("/e/", sessionPage)
+	mux.Handle("/oembed", &OEmbedHandler{DBStore: dbStore, BaseURL: options.BaseURL})
 
 	// XXX make sure that files from /userdata/ don't go through autogzip. That messes up
 	// the load progress of pdf.js.
@@ -131,6 +237,7 @@ func main() {
 	mux.HandleFunc("/contact", deliverIndex)
 	mux.HandleFunc("/tos", deliverIndex)
 	mux.HandleFunc("/settings", deliverIndex)
+	mux.HandleFunc("/reset", deliverIndex)
 
 	// deliver static files from htdocs, autogzip'd.
 	mux.Handle("/", autogzip.Handle(http.FileServer(http.Dir(options.HtdocsDir))))
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/joinmytalk/xlog"
+	"github.com/voxelbrain/goptions"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sql
+var migrationFiles embed.FS
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(.+?)(\.down)?\.sql$`)
+
+// Migration describes a single schema migration, consisting of the SQL
+// statements to apply it and, optionally, to revert it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies the migrations embedded in the binary to a database and
+// records which of them ran in the schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+}
+
+// NewMigrator creates a new Migrator for a database connection of the
+// specified driver.
+func NewMigrator(driver string, db *sql.DB) (*Migrator, error) {
+	dir := "sql"
+	if driver == "sqlite3" {
+		dir = "sql/sqlite"
+	}
+
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func loadMigrations(dir string) ([]*Migration, error) {
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+
+		version, _ := strconv.Atoi(m[1])
+		data, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		}
+		if m[3] != "" {
+			migration.Down = string(data)
+		} else {
+			migration.Up = string(data)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %02d_%s has no up statements", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// LatestVersion returns the schema version that the embedded migrations
+// lead to, i.e. the version that Store expects.
+func (m *Migrator) LatestVersion() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) init() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY NOT NULL,
+		name VARCHAR(128) NOT NULL,
+		applied DATETIME NOT NULL
+	)`)
+	return err
+}
+
+// AppliedVersions returns the versions of all migrations that have been applied,
+// in ascending order.
+func (m *Migrator) AppliedVersions() ([]int, error) {
+	if err := m.init(); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []int{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+func (m *Migrator) appliedSet() (map[int]bool, error) {
+	versions, err := m.AppliedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]bool, len(versions))
+	for _, version := range versions {
+		applied[version] = true
+	}
+
+	// databases that were bootstrapped by hand before the migration runner
+	// existed have all the tables, but nothing recorded.
+	if len(applied) == 0 {
+		if _, err := m.db.Exec("SELECT 1 FROM uploads LIMIT 1"); err == nil {
+			return nil, errors.New("database schema exists but no migrations are recorded; run \"satsuma migrate baseline --version <n>\" with the last manually applied version first")
+		}
+	}
+
+	return applied, nil
+}
+
+// Pending returns the migrations that haven't been applied yet.
+func (m *Migrator) Pending() ([]*Migration, error) {
+	applied, err := m.appliedSet()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []*Migration{}
+	for _, migration := range m.migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Check returns an error if the database schema is behind the embedded migrations.
+func (m *Migrator) Check() error {
+	pending, err := m.Pending()
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is behind: %d pending migration(s), latest version is %d", len(pending), m.LatestVersion())
+	}
+	return nil
+}
+
+// Up applies all pending migrations in order.
+func (m *Migrator) Up() error {
+	pending, err := m.Pending()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		xlog.Infof("Applying migration %02d_%s...", migration.Version, migration.Name)
+		if err := m.run(migration.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied) VALUES (?, ?, ?)", migration.Version, migration.Name, time.Now().UTC())
+			return err
+		}); err != nil {
+			return fmt.Errorf("migration %02d_%s failed: %v", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Down reverts the most recently applied migration.
+func (m *Migrator) Down() error {
+	versions, err := m.AppliedVersions()
+	if err != nil {
+		return err
+	}
+
+	if len(versions) == 0 {
+		return errors.New("no migrations have been applied")
+	}
+
+	version := versions[len(versions)-1]
+
+	var migration *Migration
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			migration = mig
+		}
+	}
+
+	if migration == nil {
+		return fmt.Errorf("migration %02d is unknown to this binary", version)
+	}
+	if migration.Down == "" {
+		return fmt.Errorf("migration %02d_%s can't be reverted", migration.Version, migration.Name)
+	}
+
+	xlog.Infof("Reverting migration %02d_%s...", migration.Version, migration.Name)
+	if err := m.run(migration.Down, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+		return err
+	}); err != nil {
+		return fmt.Errorf("reverting migration %02d_%s failed: %v", migration.Version, migration.Name, err)
+	}
+
+	return nil
+}
+
+// Baseline records all migrations up to and including version as applied
+// without running them. This is meant for databases that were bootstrapped
+// manually from the sql subdirectory.
+func (m *Migrator) Baseline(version int) error {
+	if err := m.init(); err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		if _, err := m.db.Exec("INSERT INTO schema_migrations (version, name, applied) VALUES (?, ?, ?)", migration.Version, migration.Name, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status writes the state of all known migrations to w.
+func (m *Migrator) Status(w io.Writer) error {
+	versions, err := m.AppliedVersions()
+	if err != nil {
+		return err
+	}
+
+	applied := make(map[int]bool, len(versions))
+	for _, version := range versions {
+		applied[version] = true
+	}
+
+	for _, migration := range m.migrations {
+		state := "pending"
+		if applied[migration.Version] {
+			state = "applied"
+		}
+		fmt.Fprintf(w, "%02d_%-20s %s\n", migration.Version, migration.Name, state)
+	}
+	return nil
+}
+
+// run executes the statements of a migration script and then record within
+// one transaction. Note that MySQL implicitly commits DDL statements, so a
+// failing MySQL migration may be left partially applied.
+func (m *Migrator) run(script string, record func(tx *sql.Tx) error) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range splitStatements(script) {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// splitStatements splits an SQL script into single statements. Like the mysql
+// command line client, it understands DELIMITER lines, which are required for
+// stored procedures.
+func splitStatements(script string) []string {
+	delimiter := ";"
+	statements := []string{}
+	current := []string{}
+
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToUpper(trimmed), "DELIMITER ") {
+			delimiter = strings.TrimSpace(trimmed[len("DELIMITER "):])
+			continue
+		}
+
+		if strings.HasSuffix(trimmed, delimiter) {
+			current = append(current, strings.TrimSuffix(strings.TrimRight(line, " \t\r"), delimiter))
+			statements = append(statements, strings.Join(current, "\n"))
+			current = []string{}
+			continue
+		}
+
+		current = append(current, line)
+	}
+
+	if len(current) > 0 {
+		statements = append(statements, strings.Join(current, "\n"))
+	}
+
+	return statements
+}
+
+// migrateCommand implements the "satsuma migrate" subcommand and returns the
+// process' exit code.
+func migrateCommand(args []string) int {
+	options := struct {
+		DBDriver string        `goptions:"--db-driver, description='Database driver (mysql or sqlite3)'"`
+		DSN      string        `goptions:"--dsn, description='MySQL DSN string or SQLite database file', obligatory"`
+		Help     goptions.Help `goptions:"-h, --help, description='Show this help'"`
+
+		goptions.Verbs
+		Up       struct{} `goptions:"up"`
+		Down     struct{} `goptions:"down"`
+		Status   struct{} `goptions:"status"`
+		Baseline struct {
+			Version int `goptions:"--version, description='Last migration that was applied manually', obligatory"`
+		} `goptions:"baseline"`
+	}{
+		DBDriver: "mysql",
+	}
+
+	fs := goptions.NewFlagSet("satsuma migrate", &options)
+	if err := fs.Parse(args); err != nil || options.Help || options.Verbs == "" {
+		fs.PrintHelp(os.Stderr)
+		return 1
+	}
+
+	sqldb, err := OpenDB(options.DBDriver, options.DSN)
+	if err != nil {
+		xlog.Errorf("Opening database failed: %v", err)
+		return 1
+	}
+	defer sqldb.Close()
+
+	migrator, err := NewMigrator(options.DBDriver, sqldb)
+	if err != nil {
+		xlog.Errorf("Loading migrations failed: %v", err)
+		return 1
+	}
+
+	switch options.Verbs {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		err = migrator.Down()
+	case "status":
+		err = migrator.Status(os.Stdout)
+	case "baseline":
+		err = migrator.Baseline(options.Baseline.Version)
+	}
+
+	if err != nil {
+		xlog.Errorf("migrate %s: %v", options.Verbs, err)
+		return 1
+	}
+	return 0
+}
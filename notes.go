@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+const maxNotesLength = 20000
+
+// SlideNote contains the speaker notes of one page of an upload.
+type SlideNote struct {
+	UploadID int    `meddler:"upload_id" json:"-"`
+	Page     int    `meddler:"page" json:"page"`
+	Notes    string `meddler:"notes" json:"notes"`
+}
+
+// uploadForNotes returns the upload that a notes request refers to. Only the
+// owner of an upload may work with its notes.
+func uploadForNotes(w http.ResponseWriter, r *http.Request, sessionStore sessions.Store, dbStore Store) (*Upload, bool) {
+	session, err := sessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+
+	if session.Values["userID"] == nil {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return nil, false
+	}
+
+	uploadEntry, err := dbStore.GetUploadByPublicID(r.URL.Query().Get(":id"), session.Values["userID"].(int))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	return uploadEntry, true
+}
+
+// notesPage returns the page that a notes request refers to.
+func notesPage(w http.ResponseWriter, r *http.Request) (int, bool) {
+	page, err := strconv.Atoi(r.URL.Query().Get(":page"))
+	if err != nil || page < 1 {
+		http.Error(w, "invalid page", http.StatusBadRequest)
+		return 0, false
+	}
+	return page, true
+}
+
+// GetSlideNotesHandler returns the speaker notes of all pages of an upload.
+type GetSlideNotesHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+}
+
+func (h *GetSlideNotesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	uploadEntry, ok := uploadForNotes(w, r, h.SessionStore, h.DBStore)
+	if !ok {
+		return
+	}
+
+	StatCount("get slide notes", 1)
+
+	notes, err := h.DBStore.GetSlideNotes(uploadEntry.ID)
+	if err != nil {
+		xlog.Errorf("Getting notes of upload %d failed: %v", uploadEntry.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notes)
+}
+
+// SetSlideNoteHandler sets the speaker notes of one page of an upload.
+// Setting empty notes removes them.
+type SetSlideNoteHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *SetSlideNoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+	uploadEntry, ok := uploadForNotes(w, r, h.SessionStore, h.DBStore)
+	if !ok {
+		return
+	}
+	page, ok := notesPage(w, r)
+	if !ok {
+		return
+	}
+
+	StatCount("set slide note", 1)
+
+	requestData := struct {
+		Notes string `json:"notes"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(requestData.Notes) > maxNotesLength {
+		http.Error(w, "notes too long", http.StatusBadRequest)
+		return
+	}
+
+	note := &SlideNote{UploadID: uploadEntry.ID, Page: page, Notes: requestData.Notes}
+	if err := h.DBStore.SetSlideNote(note); err != nil {
+		xlog.Errorf("Setting notes for page %d of upload %d failed: %v", page, uploadEntry.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// DeleteSlideNoteHandler removes the speaker notes of one page of an upload.
+type DeleteSlideNoteHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *DeleteSlideNoteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+	uploadEntry, ok := uploadForNotes(w, r, h.SessionStore, h.DBStore)
+	if !ok {
+		return
+	}
+	page, ok := notesPage(w, r)
+	if !ok {
+		return
+	}
+
+	StatCount("delete slide note", 1)
+
+	if err := h.DBStore.SetSlideNote(&SlideNote{UploadID: uploadEntry.ID, Page: page}); err != nil {
+		xlog.Errorf("Deleting notes for page %d of upload %d failed: %v", page, uploadEntry.ID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PublishNotesHandler sets whether the viewers of a session receive the
+// speaker notes of every page the presenter goes to. The owner and the
+// co-presenters of the session may change this.
+type PublishNotesHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *PublishNotesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if session.Values["userID"] == nil {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("publish notes", 1)
+
+	requestData := struct {
+		PublicID string `json:"session_id"`
+		Publish  bool   `json:"publish"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(requestData.PublicID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !canPresent(h.DBStore, ownerID, sessionID, session.Values["userID"].(int)) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.DBStore.SetPublishNotes(sessionID, requestData.Publish); err != nil {
+		xlog.Errorf("Setting publish_notes of session %s failed: %v", requestData.PublicID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
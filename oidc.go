@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+	"golang.org/x/oauth2"
+)
+
+// OIDCSTATE is the name of the cookie that holds the state of a login
+// through an OpenID Connect provider while the user is at the provider.
+const OIDCSTATE = "SATSUMA_OIDC"
+
+const oidcStateMaxAge = 10 * time.Minute
+
+var oidcProviderName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// oidcHTTPClient is used for all requests to OpenID Connect providers.
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// OIDCProviderConfig configures an OpenID Connect provider. Name identifies
+// the provider in URLs, Title is shown to users.
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	Title        string   `json:"title"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+}
+
+// OIDCConfig is the content of the file passed with --oidc-config.
+type OIDCConfig struct {
+	Providers []*OIDCProviderConfig `json:"providers"`
+}
+
+// LoadOIDCConfig reads and checks the OpenID Connect configuration.
+func LoadOIDCConfig(filename string) (*OIDCConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &OIDCConfig{}
+	if err := json.NewDecoder(f).Decode(config); err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %v", filename, err)
+	}
+
+	names := make(map[string]bool)
+	for _, provider := range config.Providers {
+		if !oidcProviderName.MatchString(provider.Name) {
+			return nil, fmt.Errorf("invalid OpenID Connect provider name %q", provider.Name)
+		}
+		if names[provider.Name] {
+			return nil, fmt.Errorf("duplicate OpenID Connect provider %s", provider.Name)
+		}
+		names[provider.Name] = true
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return nil, fmt.Errorf("OpenID Connect provider %s needs an issuer and a client_id", provider.Name)
+		}
+		if provider.Title == "" {
+			provider.Title = provider.Name
+		}
+	}
+
+	return config, nil
+}
+
+// oidcProvider is a configured OpenID Connect provider. Its discovery
+// document is fetched when it is first used, so that an unavailable
+// provider doesn't keep satsuma from starting.
+type oidcProvider struct {
+	config   *OIDCProviderConfig
+	mtx      sync.Mutex
+	provider *oidc.Provider
+}
+
+func (p *oidcProvider) discover() (*oidc.Provider, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.provider == nil {
+		// the context also provides the HTTP client for fetching the
+		// provider's keys later on, so it must outlive the request.
+		provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), oidcHTTPClient), p.config.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		p.provider = provider
+	}
+	return p.provider, nil
+}
+
+func (p *oidcProvider) oauth2Config(provider *oidc.Provider, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, p.config.Scopes...),
+	}
+}
+
+// OIDCLogin logs in users through OpenID Connect providers, using the
+// authorization code flow with PKCE. Accounts are named <issuer>:<subject>.
+type OIDCLogin struct {
+	BaseURL      string
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+
+	providers []*oidcProvider
+}
+
+// NewOIDCLogin returns an OIDCLogin for the providers in config.
+func NewOIDCLogin(config *OIDCConfig, baseURL string, sessionStore sessions.Store, dbStore Store, secureCookie *securecookie.SecureCookie) *OIDCLogin {
+	login := &OIDCLogin{BaseURL: baseURL, SessionStore: sessionStore, DBStore: dbStore, SecureCookie: secureCookie}
+	for _, provider := range config.Providers {
+		login.providers = append(login.providers, &oidcProvider{config: provider})
+	}
+	return login
+}
+
+func (l *OIDCLogin) provider(name string) *oidcProvider {
+	for _, p := range l.providers {
+		if p.config.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// System returns the name under which the account identified by username
+// is listed as connected, or an empty string if it doesn't belong to one of
+// the providers. The issuer of an account is everything before the last
+// colon; it has to match exactly, so that e.g. https://idp doesn't claim the
+// accounts of https://idp:8443.
+func (l *OIDCLogin) System(username string) string {
+	i := strings.LastIndex(username, ":")
+	if i < 0 {
+		return ""
+	}
+	for _, p := range l.providers {
+		if username[:i] == p.config.Issuer {
+			return "oidc:" + p.config.Name
+		}
+	}
+	return ""
+}
+
+func (l *OIDCLogin) redirectURL(r *http.Request, name string) string {
+	return publicBaseURL(l.BaseURL, r) + "/auth/oidc/" + name + "/callback"
+}
+
+// oidcState is kept in the OIDCSTATE cookie while the user is at the
+// provider.
+type oidcState struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string
+	Created  time.Time
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// OIDCStartHandler sends the user to an OpenID Connect provider to log in.
+type OIDCStartHandler struct {
+	Login *OIDCLogin
+}
+
+func (h *OIDCStartHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":provider")
+	p := h.Login.provider(name)
+	if p == nil {
+		http.Error(w, "unknown provider", http.StatusNotFound)
+		return
+	}
+
+	StatCount("oidc login "+name, 1)
+
+	provider, err := p.discover()
+	if err != nil {
+		xlog.Errorf("Discovering OpenID Connect provider %s failed: %v", name, err)
+		http.Error(w, "provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := &oidcState{Provider: name, Verifier: oauth2.GenerateVerifier(), Created: time.Now()}
+	if state.State, err = randomToken(); err == nil {
+		state.Nonce, err = randomToken()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	encoded, err := h.Login.SecureCookie.Encode(OIDCSTATE, state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: OIDCSTATE, Value: encoded, Path: "/auth/oidc/", MaxAge: int(oidcStateMaxAge.Seconds()), HttpOnly: true})
+
+	config := p.oauth2Config(provider, h.Login.redirectURL(r, name))
+	http.Redirect(w, r, config.AuthCodeURL(state.State, oidc.Nonce(state.Nonce), oauth2.S256ChallengeOption(state.Verifier)), http.StatusFound)
+}
+
+// OIDCCallbackHandler handles the user coming back from an OpenID Connect
+// provider. It verifies the ID token and logs in the user of the account, or
+// connects the account to the user that is already logged in.
+type OIDCCallbackHandler struct {
+	Login *OIDCLogin
+}
+
+func (h *OIDCCallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":provider")
+	p := h.Login.provider(name)
+	if p == nil {
+		http.Error(w, "unknown provider", http.StatusNotFound)
+		return
+	}
+
+	state, err := h.Login.state(r, name)
+	http.SetCookie(w, &http.Cookie{Name: OIDCSTATE, Value: "", Path: "/auth/oidc/", MaxAge: -1})
+	if err != nil {
+		xlog.Errorf("OpenID Connect callback from %s: %v", name, err)
+		StatCount("oidc login failed", 1)
+		http.Error(w, "invalid login state, please try again", http.StatusForbidden)
+		return
+	}
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		xlog.Infof("OpenID Connect provider %s returned error %s: %s", name, errCode, r.URL.Query().Get("error_description"))
+		StatCount("oidc login failed", 1)
+		http.Error(w, "login failed: "+errCode, http.StatusForbidden)
+		return
+	}
+
+	provider, err := p.discover()
+	if err != nil {
+		xlog.Errorf("Discovering OpenID Connect provider %s failed: %v", name, err)
+		http.Error(w, "provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	ctx := oidc.ClientContext(r.Context(), oidcHTTPClient)
+	config := p.oauth2Config(provider, h.Login.redirectURL(r, name))
+	token, err := config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		xlog.Errorf("Exchanging authorization code with %s failed: %v", name, err)
+		StatCount("oidc login failed", 1)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		xlog.Errorf("OpenID Connect provider %s didn't return an ID token", name)
+		StatCount("oidc login failed", 1)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.config.ClientID}).Verify(ctx, rawIDToken)
+	if err == nil && idToken.Nonce != state.Nonce {
+		err = errors.New("nonce mismatch")
+	}
+	if err != nil {
+		xlog.Errorf("Verifying ID token from %s failed: %v", name, err)
+		StatCount("oidc login failed", 1)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+
+	claims := struct {
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}{}
+	if err := idToken.Claims(&claims); err != nil {
+		xlog.Errorf("Decoding claims of ID token from %s failed: %v", name, err)
+	}
+
+	connectAccount(w, r, &Account{Username: idToken.Issuer + ":" + idToken.Subject, Email: claims.Email, Name: claims.Name},
+		h.Login.SessionStore, h.Login.SecureCookie, h.Login.DBStore)
+}
+
+// state returns the login state of a callback request from a provider,
+// identified by its name.
+func (l *OIDCLogin) state(r *http.Request, name string) (*oidcState, error) {
+	cookie, err := r.Cookie(OIDCSTATE)
+	if err != nil {
+		return nil, errors.New("no state cookie")
+	}
+
+	state := &oidcState{}
+	if err := l.SecureCookie.Decode(OIDCSTATE, cookie.Value, state); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case state.Provider != name:
+		return nil, errors.New("provider mismatch")
+	case state.State != r.URL.Query().Get("state"):
+		return nil, errors.New("state mismatch")
+	case time.Since(state.Created) > oidcStateMaxAge:
+		return nil, errors.New("state expired")
+	}
+	return state, nil
+}
+
+// OIDCProvidersHandler lists the OpenID Connect providers that users can
+// log in with.
+type OIDCProvidersHandler struct {
+	Login *OIDCLogin
+}
+
+func (h *OIDCProvidersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	providers := []map[string]string{}
+	for _, p := range h.Login.providers {
+		providers = append(providers, map[string]string{"name": p.config.Name, "title": p.config.Title})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// stubIssuer is a minimal OpenID Connect provider. It serves the discovery
+// document, its signing key and the token endpoint, which checks the PKCE
+// verifier of the authorization codes that authorize hands out.
+type stubIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	// Subject is the subject of the ID tokens. Unless they are empty, Nonce
+	// replaces the nonce of the authorization request in the ID tokens and
+	// Expiry their expiry time.
+	Subject string
+	Nonce   string
+	Expiry  time.Time
+
+	mtx   sync.Mutex
+	codes map[string]url.Values
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stubIssuer{key: key, Subject: "alice", codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                s.URL,
+			"authorization_endpoint":                s.URL + "/authorize",
+			"token_endpoint":                        s.URL + "/token",
+			"jwks_uri":                              s.URL + "/keys",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &s.key.PublicKey, KeyID: "stub", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// authorize plays the user logging in at the provider, given the URL that
+// OIDCStartHandler redirected to, and returns the query of the redirect back
+// to satsuma.
+func (s *stubIssuer) authorize(t *testing.T, location string) url.Values {
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location, s.URL+"/authorize?") {
+		t.Fatalf("redirected to %s instead of the authorization endpoint", location)
+	}
+
+	q := u.Query()
+	for _, param := range []string{"state", "nonce", "code_challenge"} {
+		if q.Get(param) == "" {
+			t.Fatalf("authorization request without %s: %s", param, location)
+		}
+	}
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("got code_challenge_method %q, want S256", q.Get("code_challenge_method"))
+	}
+
+	code, _ := randomToken()
+	s.mtx.Lock()
+	s.codes[code] = q
+	s.mtx.Unlock()
+
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+func (s *stubIssuer) token(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	authorization := s.codes[r.FormValue("code")]
+	delete(s.codes, r.FormValue("code"))
+	s.mtx.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if authorization == nil || base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.Get("code_challenge") ||
+		r.FormValue("redirect_uri") != authorization.Get("redirect_uri") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	nonce, expiry := authorization.Get("nonce"), time.Now().Add(time.Hour)
+	if s.Nonce != "" {
+		nonce = s.Nonce
+	}
+	if !s.Expiry.IsZero() {
+		expiry = s.Expiry
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss":   s.URL,
+		"sub":   s.Subject,
+		"aud":   authorization.Get("client_id"),
+		"iat":   time.Now().Unix(),
+		"exp":   expiry.Unix(),
+		"nonce": nonce,
+		"email": s.Subject + "@example.com",
+		"name":  "Alice",
+	})
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: s.key, KeyID: "stub"}}, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, _ := signed.CompactSerialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "stub", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+}
+
+// oidcRequest returns a request for an OpenID Connect handler of the stub
+// provider, with the route parameter that pat would add.
+func oidcRequest(path string, query url.Values, cookies []*http.Cookie) *http.Request {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set(":provider", "stub")
+	r := httptest.NewRequest("GET", "http://satsuma.test"+path+"?"+query.Encode(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newStubIssuer(t)
+	defer issuer.Close()
+
+	tests := []struct {
+		name string
+		// state and query modify the login state in the cookie and the
+		// query of the callback, nonce and expiry the ID token.
+		state    func(*oidcState)
+		query    func(url.Values)
+		nonce    string
+		expiry   time.Time
+		wantCode int
+	}{
+		{name: "success", wantCode: http.StatusFound},
+		{name: "state mismatch", query: func(q url.Values) { q.Set("state", "forged") }, wantCode: http.StatusForbidden},
+		{name: "state expired", state: func(s *oidcState) { s.Created = time.Now().Add(-oidcStateMaxAge - time.Minute) }, wantCode: http.StatusForbidden},
+		{name: "wrong PKCE verifier", state: func(s *oidcState) { s.Verifier = strings.Repeat("x", 43) }, wantCode: http.StatusForbidden},
+		{name: "unknown code", query: func(q url.Values) { q.Set("code", "forged") }, wantCode: http.StatusForbidden},
+		{name: "nonce mismatch", nonce: "forged", wantCode: http.StatusForbidden},
+		{name: "ID token expired", expiry: time.Now().Add(-time.Minute), wantCode: http.StatusForbidden},
+		{name: "provider error", query: func(q url.Values) { q.Set("error", "access_denied") }, wantCode: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		dbStore, sqldb := newTestStore(t)
+		secureCookie := securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+		sessionStore := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+		config := &OIDCConfig{Providers: []*OIDCProviderConfig{{Name: "stub", Issuer: issuer.URL, ClientID: "satsuma", ClientSecret: "secret"}}}
+		login := NewOIDCLogin(config, "http://satsuma.test", sessionStore, dbStore, secureCookie)
+
+		issuer.Nonce, issuer.Expiry = test.nonce, test.expiry
+
+		w := httptest.NewRecorder()
+		(&OIDCStartHandler{Login: login}).ServeHTTP(w, oidcRequest("/auth/oidc/stub", nil, nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("%s: start returned %d: %s", test.name, w.Code, w.Body)
+		}
+
+		cookies := w.Result().Cookies()
+		if test.state != nil {
+			state := &oidcState{}
+			if err := secureCookie.Decode(OIDCSTATE, cookies[0].Value, state); err != nil {
+				t.Fatal(err)
+			}
+			test.state(state)
+			cookies[0].Value, _ = secureCookie.Encode(OIDCSTATE, state)
+		}
+
+		query := issuer.authorize(t, w.Header().Get("Location"))
+		if test.query != nil {
+			test.query(query)
+		}
+
+		w = httptest.NewRecorder()
+		(&OIDCCallbackHandler{Login: login}).ServeHTTP(w, oidcRequest("/auth/oidc/stub/callback", query, cookies))
+		if w.Code != test.wantCode {
+			t.Errorf("%s: callback returned %d, want %d: %s", test.name, w.Code, test.wantCode, w.Body)
+		}
+
+		var userID int
+		err := sqldb.QueryRow("SELECT user_id FROM accounts WHERE username = ?", issuer.URL+":alice").Scan(&userID)
+		if test.wantCode == http.StatusFound && err != nil {
+			t.Errorf("%s: account %s:alice wasn't created: %v", test.name, issuer.URL, err)
+		} else if test.wantCode != http.StatusFound && err != sql.ErrNoRows {
+			t.Errorf("%s: got account for user %d (%v), want none", test.name, userID, err)
+		}
+		sqldb.Close()
+	}
+}
+
+func TestOIDCLoginSystem(t *testing.T) {
+	config := &OIDCConfig{Providers: []*OIDCProviderConfig{
+		{Name: "idp", Issuer: "https://idp"},
+		{Name: "other", Issuer: "https://idp:8443/realms/other"},
+	}}
+	login := NewOIDCLogin(config, "", nil, nil, nil)
+
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"https://idp:alice", "oidc:idp"},
+		{"https://idp:8443/realms/other:alice", "oidc:other"},
+		{"https://idp:8443:alice", ""},
+		{"https://idp/realms/other:alice", ""},
+		{"https://idp", ""},
+		{"google:alice", ""},
+	}
+
+	for _, test := range tests {
+		if got := login.System(test.username); got != test.want {
+			t.Errorf("System(%q) = %q, want %q", test.username, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/joinmytalk/satsuma/pdfmeta"
+)
+
+// StoreMetadata reads the page metadata of the converted PDF file of an
+// upload, identified by its publicId, and stores it with pdfmeta.Store.
+func (c *Converter) StoreMetadata(pdfFile, publicId string) error {
+	doc, err := pdfmeta.Read(pdfFile)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	var uploadID int
+	if err := tx.QueryRow("SELECT id FROM uploads WHERE public_id = ?", publicId).Scan(&uploadID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := pdfmeta.Store(tx, uploadID, doc); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
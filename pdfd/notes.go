@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	relationshipsNS = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	notesSlideType  = relationshipsNS + "/notesSlide"
+
+	odpMimeType    = "application/vnd.oasis.opendocument.presentation"
+	drawNS         = "urn:oasis:names:tc:opendocument:xmlns:drawing:1.0"
+	presentationNS = "urn:oasis:names:tc:opendocument:xmlns:presentation:1.0"
+	styleNS        = "urn:oasis:names:tc:opendocument:xmlns:style:1.0"
+	textNS         = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+
+	// maxODPSpaces limits the number of spaces that a single text:s element
+	// of an ODP file may stand for.
+	maxODPSpaces = 100
+)
+
+// StoreNotes extracts the speaker notes from the source file of an upload,
+// identified by its publicId, and stores them in the slide_notes table.
+func (c *Converter) StoreNotes(srcFile, publicId string) error {
+	notes, err := ExtractNotes(srcFile)
+	if err != nil || len(notes) == 0 {
+		return err
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM slide_notes WHERE upload_id = (SELECT id FROM uploads WHERE public_id = ?)", publicId); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for page, text := range notes {
+		if _, err := tx.Exec("INSERT INTO slide_notes (upload_id, page, notes) SELECT id, ?, ? FROM uploads WHERE public_id = ?", page, text, publicId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ExtractNotes returns the speaker notes of a PPTX or ODP file, indexed by
+// the page number of the slide in the converted PDF. Hidden slides aren't
+// converted, so they don't count. For all other files, it returns nil.
+func ExtractNotes(src string) (map[int]string, error) {
+	r, err := zip.OpenReader(src)
+	if err == zip.ErrFormat {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	if files["ppt/presentation.xml"] != nil {
+		return extractPPTXNotes(files)
+	}
+
+	if files["mimetype"] != nil && files["content.xml"] != nil {
+		mimeType, err := readZipFile(files["mimetype"])
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(mimeType)) == odpMimeType {
+			return extractODPNotes(files["content.xml"])
+		}
+	}
+
+	return nil, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func decodeZipFile(f *zip.File, v interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+type pptxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Type   string `xml:"Type,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// readRelationships returns the targets of the relationships of a part of a
+// PPTX file, indexed by relationship ID, and the target of the notes slide
+// of the part, if it has one.
+func readRelationships(files map[string]*zip.File, part string) (targets map[string]string, notesSlide string, err error) {
+	targets = make(map[string]string)
+
+	relsFile := files[path.Join(path.Dir(part), "_rels", path.Base(part)+".rels")]
+	if relsFile == nil {
+		return targets, "", nil
+	}
+
+	var rels pptxRelationships
+	if err := decodeZipFile(relsFile, &rels); err != nil {
+		return nil, "", err
+	}
+
+	for _, rel := range rels.Relationships {
+		target := path.Join(path.Dir(part), rel.Target)
+		if strings.HasPrefix(rel.Target, "/") {
+			target = strings.TrimPrefix(rel.Target, "/")
+		}
+		targets[rel.ID] = target
+		if rel.Type == notesSlideType {
+			notesSlide = target
+		}
+	}
+
+	return targets, notesSlide, nil
+}
+
+func extractPPTXNotes(files map[string]*zip.File) (map[int]string, error) {
+	var presentation struct {
+		Slides []struct {
+			RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sldIdLst>sldId"`
+	}
+	if err := decodeZipFile(files["ppt/presentation.xml"], &presentation); err != nil {
+		return nil, err
+	}
+
+	slides, _, err := readRelationships(files, "ppt/presentation.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make(map[int]string)
+	page := 0
+	for _, slideID := range presentation.Slides {
+		slidePart := slides[slideID.RelID]
+		if files[slidePart] == nil {
+			continue
+		}
+
+		var slide struct {
+			Show string `xml:"show,attr"`
+		}
+		if err := decodeZipFile(files[slidePart], &slide); err != nil {
+			return nil, err
+		}
+		if slide.Show == "0" || slide.Show == "false" {
+			continue
+		}
+		page++
+
+		_, notesPart, err := readRelationships(files, slidePart)
+		if err != nil {
+			return nil, err
+		}
+		if files[notesPart] == nil {
+			continue
+		}
+
+		text, err := readPPTXNotesSlide(files[notesPart])
+		if err != nil {
+			return nil, err
+		}
+		if text != "" {
+			notes[page] = text
+		}
+	}
+
+	return notes, nil
+}
+
+// readPPTXNotesSlide returns the text of the body placeholder of a notes
+// slide. The other shapes on a notes slide hold the slide image, the slide
+// number and similar things.
+func readPPTXNotesSlide(f *zip.File) (string, error) {
+	var notesSlide struct {
+		Shapes []struct {
+			Placeholder *struct {
+				Type string `xml:"type,attr"`
+			} `xml:"nvSpPr>nvPr>ph"`
+			Paragraphs []struct {
+				Runs []string `xml:"r>t"`
+			} `xml:"txBody>p"`
+		} `xml:"cSld>spTree>sp"`
+	}
+	if err := decodeZipFile(f, &notesSlide); err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for _, shape := range notesSlide.Shapes {
+		if shape.Placeholder == nil || shape.Placeholder.Type != "body" {
+			continue
+		}
+		for _, p := range shape.Paragraphs {
+			lines = append(lines, strings.Join(p.Runs, ""))
+		}
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+func extractODPNotes(f *zip.File) (map[int]string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var (
+		notes       = make(map[int]string)
+		hidden      = make(map[string]bool)
+		pageStyle   string
+		page        int
+		inPage      bool
+		inNotes     bool
+		inNotesText bool
+		inParagraph bool
+		lines       []string
+		line        []string
+	)
+
+	attr := func(e xml.StartElement, space, local string) string {
+		for _, a := range e.Attr {
+			if a.Name.Space == space && a.Name.Local == local {
+				return a.Value
+			}
+		}
+		return ""
+	}
+
+	decoder := xml.NewDecoder(rc)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Space == styleNS && t.Name.Local == "style":
+				pageStyle = ""
+				if attr(t, styleNS, "family") == "drawing-page" {
+					pageStyle = attr(t, styleNS, "name")
+				}
+			case t.Name.Space == styleNS && t.Name.Local == "drawing-page-properties":
+				if pageStyle != "" && attr(t, presentationNS, "visibility") == "hidden" {
+					hidden[pageStyle] = true
+				}
+			case t.Name.Space == drawNS && t.Name.Local == "page":
+				inPage = !hidden[attr(t, drawNS, "style-name")]
+				if inPage {
+					page++
+				}
+			case t.Name.Space == presentationNS && t.Name.Local == "notes":
+				inNotes = inPage
+				lines = nil
+			case t.Name.Space == drawNS && t.Name.Local == "frame":
+				inNotesText = inNotes && attr(t, presentationNS, "class") == "notes"
+			case t.Name.Space == textNS && (t.Name.Local == "p" || t.Name.Local == "h"):
+				inParagraph = inNotesText
+				line = nil
+			case inParagraph && t.Name.Space == textNS && t.Name.Local == "s":
+				count, err := strconv.Atoi(attr(t, textNS, "c"))
+				if err != nil || count < 1 {
+					count = 1
+				} else if count > maxODPSpaces {
+					count = maxODPSpaces
+				}
+				line = append(line, strings.Repeat(" ", count))
+			case inParagraph && t.Name.Space == textNS && t.Name.Local == "tab":
+				line = append(line, "\t")
+			case inParagraph && t.Name.Space == textNS && t.Name.Local == "line-break":
+				line = append(line, "\n")
+			}
+		case xml.CharData:
+			if inParagraph {
+				line = append(line, string(t))
+			}
+		case xml.EndElement:
+			switch {
+			case t.Name.Space == textNS && (t.Name.Local == "p" || t.Name.Local == "h"):
+				if inParagraph {
+					lines = append(lines, strings.Join(line, ""))
+				}
+				inParagraph = false
+			case t.Name.Space == drawNS && t.Name.Local == "frame":
+				inNotesText = false
+			case t.Name.Space == presentationNS && t.Name.Local == "notes":
+				if text := strings.TrimSpace(strings.Join(lines, "\n")); inNotes && text != "" {
+					notes[page] = text
+				}
+				inNotes = false
+			case t.Name.Space == drawNS && t.Name.Local == "page":
+				inPage = false
+			}
+		}
+	}
+
+	return notes, nil
+}
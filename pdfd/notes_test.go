@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	pptxRelationshipsXML = `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">%s</Relationships>`
+
+	pptxNotesSlideXML = `<?xml version="1.0" encoding="UTF-8"?>
+<p:notes xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main" xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main">
+<p:cSld><p:spTree>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="sldImg"/></p:nvPr></p:nvSpPr></p:sp>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="body" idx="1"/></p:nvPr></p:nvSpPr><p:txBody>%s</p:txBody></p:sp>
+<p:sp><p:nvSpPr><p:nvPr><p:ph type="sldNum"/></p:nvPr></p:nvSpPr><p:txBody><a:p><a:r><a:t>1</a:t></a:r></a:p></p:txBody></p:sp>
+</p:spTree></p:cSld>
+</p:notes>`
+
+	odpContentXML = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:style="urn:oasis:names:tc:opendocument:xmlns:style:1.0" xmlns:draw="urn:oasis:names:tc:opendocument:xmlns:drawing:1.0" xmlns:presentation="urn:oasis:names:tc:opendocument:xmlns:presentation:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:automatic-styles>
+<style:style style:family="drawing-page" style:name="dp1"><style:drawing-page-properties presentation:visibility="visible"/></style:style>
+<style:style style:family="drawing-page" style:name="dp2"><style:drawing-page-properties presentation:visibility="hidden"/></style:style>
+</office:automatic-styles>
+<office:body><office:presentation>%s</office:presentation></office:body>
+</office:document-content>`
+)
+
+// pptxFiles returns the parts of a PPTX file with a slide for each element
+// of notes. An empty string means that the slide has no notes slide, and a
+// "hidden:" prefix makes the slide hidden.
+func pptxFiles(notes ...string) map[string]string {
+	files := make(map[string]string)
+
+	var slideIDs, presentationRels string
+	for i, text := range notes {
+		n := strconv.Itoa(i + 1)
+		slideIDs += `<p:sldId id="` + strconv.Itoa(256+i) + `" r:id="rId` + n + `"/>`
+		presentationRels += `<Relationship Id="rId` + n + `" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slide" Target="slides/slide` + n + `.xml"/>`
+
+		show := ""
+		if strings.HasPrefix(text, "hidden:") {
+			show = ` show="0"`
+			text = strings.TrimPrefix(text, "hidden:")
+		}
+		files["ppt/slides/slide"+n+".xml"] = `<p:sld xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main"` + show + `><p:cSld/></p:sld>`
+
+		if text == "" {
+			continue
+		}
+		files["ppt/slides/_rels/slide"+n+".xml.rels"] = strings.Replace(pptxRelationshipsXML, "%s", `<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/notesSlide" Target="../notesSlides/notesSlide`+n+`.xml"/>`, 1)
+
+		var paragraphs string
+		for _, line := range strings.Split(text, "\n") {
+			paragraphs += `<a:p><a:r><a:t>` + line + `</a:t></a:r></a:p>`
+		}
+		files["ppt/notesSlides/notesSlide"+n+".xml"] = strings.Replace(pptxNotesSlideXML, "%s", paragraphs, 1)
+	}
+
+	files["ppt/presentation.xml"] = `<p:presentation xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><p:sldIdLst>` + slideIDs + `</p:sldIdLst></p:presentation>`
+	files["ppt/_rels/presentation.xml.rels"] = strings.Replace(pptxRelationshipsXML, "%s", presentationRels, 1)
+	return files
+}
+
+// odpFiles returns the parts of an ODP file whose presentation consists of
+// pages.
+func odpFiles(pages string) map[string]string {
+	return map[string]string{
+		"mimetype":    "application/vnd.oasis.opendocument.presentation",
+		"content.xml": strings.Replace(odpContentXML, "%s", pages, 1),
+	}
+}
+
+func odpPage(style, notes string) string {
+	return `<draw:page draw:style-name="` + style + `"><draw:frame><draw:text-box><text:p>Slide text</text:p></draw:text-box></draw:frame>` +
+		`<presentation:notes><draw:frame presentation:class="page"/><draw:frame presentation:class="notes"><draw:text-box>` + notes + `</draw:text-box></draw:frame></presentation:notes></draw:page>`
+}
+
+func writeZip(t *testing.T, files map[string]string) string {
+	f, err := ioutil.TempFile("", "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestExtractNotes(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[int]string
+	}{
+		{
+			name:  "pptx",
+			files: pptxFiles("First slide", "", "Third slide\nsecond line"),
+			want:  map[int]string{1: "First slide", 3: "Third slide\nsecond line"},
+		},
+		{
+			name:  "pptx with hidden slide",
+			files: pptxFiles("First slide", "hidden:Hidden slide", "Third slide"),
+			want:  map[int]string{1: "First slide", 2: "Third slide"},
+		},
+		{
+			name: "odp",
+			files: odpFiles(odpPage("dp1", `<text:p>One<text:s text:c="3"/>two<text:tab/>three</text:p><text:p>Second<text:line-break/>line</text:p>`) +
+				odpPage("dp1", "") +
+				odpPage("dp1", `<text:h>Heading</text:h>`)),
+			want: map[int]string{1: "One   two\tthree\nSecond\nline", 3: "Heading"},
+		},
+		{
+			name:  "odp with hidden page",
+			files: odpFiles(odpPage("dp2", `<text:p>Hidden</text:p>`) + odpPage("dp1", `<text:p>Visible</text:p>`)),
+			want:  map[int]string{1: "Visible"},
+		},
+		{
+			name:  "odp with invalid space counts",
+			files: odpFiles(odpPage("dp1", `<text:p>a<text:s text:c="-1"/>b<text:s text:c="x"/>c<text:s text:c="99999999999"/>d</text:p>`)),
+			want:  map[int]string{1: "a b c" + strings.Repeat(" ", maxODPSpaces) + "d"},
+		},
+		{
+			name:  "other zip file",
+			files: map[string]string{"mimetype": "application/vnd.oasis.opendocument.text", "content.xml": "<x/>"},
+			want:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		src := writeZip(t, test.files)
+		defer os.Remove(src)
+
+		notes, err := ExtractNotes(src)
+		if err != nil {
+			t.Errorf("%s: ExtractNotes failed: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(notes, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, notes, test.want)
+		}
+	}
+}
+
+func TestExtractNotesFromPDF(t *testing.T) {
+	f, err := ioutil.TempFile("", "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("%PDF-1.4\n")
+	f.Close()
+
+	notes, err := ExtractNotes(f.Name())
+	if err != nil || notes != nil {
+		t.Errorf("got %v, %v, want no notes", notes, err)
+	}
+}
+
+// openZip opens the archive at src and returns its files, indexed by name.
+func openZip(t *testing.T, src string) (*zip.ReadCloser, map[string]*zip.File) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+	return r, files
+}
+
+func TestExtractPPTXNotes(t *testing.T) {
+	missingSlide := pptxFiles("First slide", "Second slide")
+	delete(missingSlide, "ppt/slides/slide1.xml")
+
+	missingNotes := pptxFiles("First slide", "Second slide")
+	delete(missingNotes, "ppt/notesSlides/notesSlide2.xml")
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    map[int]string
+		wantErr bool
+	}{
+		{name: "no slides", files: pptxFiles(), want: map[int]string{}},
+		{name: "missing slide", files: missingSlide, want: map[int]string{1: "Second slide"}},
+		{name: "missing notes slide", files: missingNotes, want: map[int]string{1: "First slide"}},
+		{name: "broken notes slide", files: pptxFiles("First <slide"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		src := writeZip(t, test.files)
+		defer os.Remove(src)
+
+		r, files := openZip(t, src)
+		notes, err := extractPPTXNotes(files)
+		r.Close()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error: %t", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(notes, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, notes, test.want)
+		}
+	}
+}
+
+func TestExtractODPNotes(t *testing.T) {
+	tests := []struct {
+		name    string
+		pages   string
+		want    map[int]string
+		wantErr bool
+	}{
+		{name: "no pages", pages: "", want: map[int]string{}},
+		{name: "empty notes", pages: odpPage("dp1", `<text:p>  </text:p>`), want: map[int]string{}},
+		{name: "unknown page style", pages: odpPage("dp3", `<text:p>Notes</text:p>`), want: map[int]string{1: "Notes"}},
+		{name: "negative space count", pages: odpPage("dp1", `<text:p>a<text:s text:c="-1"/>b</text:p>`), want: map[int]string{1: "a b"}},
+		{name: "huge space count", pages: odpPage("dp1", `<text:p>a<text:s text:c="2147483647"/>b</text:p>`), want: map[int]string{1: "a" + strings.Repeat(" ", maxODPSpaces) + "b"}},
+		{name: "broken XML", pages: `<draw:page>`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		src := writeZip(t, odpFiles(test.pages))
+		defer os.Remove(src)
+
+		r, files := openZip(t, src)
+		notes, err := extractODPNotes(files["content.xml"])
+		r.Close()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error: %t", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(notes, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, notes, test.want)
+		}
+	}
+}
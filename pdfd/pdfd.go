@@ -6,7 +6,9 @@ import (
 	"github.com/bitly/go-nsq"
 	"github.com/bitly/go-simplejson"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/joinmytalk/satsuma/thumbnails"
 	"github.com/joinmytalk/xlog"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/voxelbrain/goptions"
 	"io"
 	"os"
@@ -17,15 +19,22 @@ func main() {
 	xlog.SetOutput(os.Stdout)
 
 	options := struct {
-		Topic   string `goptions:"--topic, description='Topic', obligatory"`
-		Channel string `goptions:"--channel, description='Channel', obligatory"`
-		Lookupd string `goptions:"--lookupd, description='lookupd address', obligatory"`
-		DSN     string `goptions:"--dsn, description='MySQL DSN string', obligatory"`
-	}{}
+		Topic    string `goptions:"--topic, description='Topic', obligatory"`
+		Channel  string `goptions:"--channel, description='Channel', obligatory"`
+		Lookupd  string `goptions:"--lookupd, description='lookupd address', obligatory"`
+		DBDriver string `goptions:"--db-driver, description='Database driver (mysql or sqlite3)'"`
+		DSN      string `goptions:"--dsn, description='MySQL DSN string or SQLite database file', obligatory"`
+	}{
+		DBDriver: "mysql",
+	}
 
 	goptions.ParseAndFail(&options)
 
-	sqldb, err := sql.Open("mysql", options.DSN)
+	if options.DBDriver != "mysql" && options.DBDriver != "sqlite3" {
+		xlog.Fatalf("unsupported database driver %s", options.DBDriver)
+	}
+
+	sqldb, err := sql.Open(options.DBDriver, options.DSN)
 	if err != nil {
 		xlog.Fatalf("sql.Open failed: %v", err)
 	}
@@ -61,26 +70,41 @@ func (c *Converter) HandleMessage(message *nsq.Message) error {
 	targetFile := msg.Get("target_file").MustString()
 	publicId := msg.Get("upload_id").MustString()
 
-	if _, err := os.Stat(targetFile); err == nil {
-		xlog.Debugf("target file %s already exists.", targetFile)
-		return nil
-	}
+	// PDF uploads are queued with the PDF file as both the source and the
+	// target file, so that there is nothing to convert.
+	if srcFile != targetFile {
+		if _, err := os.Stat(targetFile); err == nil {
+			xlog.Debugf("target file %s already exists.", targetFile)
+			return nil
+		}
 
-	if err := ConvertFileToPDF(srcFile, targetFile); err != nil {
-		xlog.Errorf("Converting %s to %s failed: %v", srcFile, targetFile, err)
-		_, err = c.DB.Exec("UPDATE uploads SET conversion = 'error' WHERE public_id = ?", publicId)
-		if err != nil {
-			xlog.Errorf("Updating conversion status for %s failed: %v", publicId, err)
+		if err := ConvertFileToPDF(srcFile, targetFile); err != nil {
+			xlog.Errorf("Converting %s to %s failed: %v", srcFile, targetFile, err)
+			_, err = c.DB.Exec("UPDATE uploads SET conversion = 'error' WHERE public_id = ?", publicId)
+			if err != nil {
+				xlog.Errorf("Updating conversion status for %s failed: %v", publicId, err)
+			}
+			os.Remove(srcFile)
+			os.Remove(targetFile)
+			return nil
 		}
-		os.Remove(srcFile)
-		os.Remove(targetFile)
-		return nil
-	} else {
-		_, err = c.DB.Exec("UPDATE uploads SET conversion = 'success' WHERE public_id = ?", publicId)
-		if err != nil {
-			xlog.Errorf("Updating conversion status for %s failed: %v", publicId, err)
+
+		if err := c.StoreNotes(srcFile, publicId); err != nil {
+			xlog.Errorf("Storing notes of %s for %s failed: %v", srcFile, publicId, err)
 		}
 	}
+
+	if err := c.StoreMetadata(targetFile, publicId); err != nil {
+		xlog.Errorf("Storing metadata of %s for %s failed: %v", targetFile, publicId, err)
+	}
+	if count, err := thumbnails.Render(targetFile); err != nil {
+		xlog.Errorf("Rendering thumbnails of %s failed: %v", targetFile, err)
+	} else if _, err := c.DB.Exec("UPDATE uploads SET thumbnails = ? WHERE public_id = ?", count, publicId); err != nil {
+		xlog.Errorf("Updating thumbnails for %s failed: %v", publicId, err)
+	}
+	if _, err := c.DB.Exec("UPDATE uploads SET conversion = 'success' WHERE public_id = ?", publicId); err != nil {
+		xlog.Errorf("Updating conversion status for %s failed: %v", publicId, err)
+	}
 	xlog.Debugf("Conversion of upload %s finished.", publicId)
 
 	return nil
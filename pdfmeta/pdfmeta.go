@@ -0,0 +1,148 @@
+// Package pdfmeta reads the page count, the page sizes and the text of PDF
+// files. It uses pdfinfo and pdftotext from poppler-utils.
+package pdfmeta
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxTermLength is the maximum length of a term in bytes. Longer terms are
+// truncated.
+const MaxTermLength = 64
+
+// Page describes a single page of a PDF file. Width and height are in
+// points, with the page's rotation already applied.
+type Page struct {
+	Number int
+	Width  float64
+	Height float64
+	Text   string
+}
+
+// Document describes a PDF file.
+type Document struct {
+	Pages []*Page
+}
+
+// Read reads the metadata of a PDF file.
+func Read(filename string) (*Document, error) {
+	output, err := run("pdfinfo", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := parsePageCount(output)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &Document{Pages: make([]*Page, count)}
+	for i := range doc.Pages {
+		doc.Pages[i] = &Page{Number: i + 1}
+	}
+	if count == 0 {
+		return doc, nil
+	}
+
+	output, err = run("pdfinfo", "-f", "1", "-l", strconv.Itoa(count), filename)
+	if err != nil {
+		return nil, err
+	}
+	parsePageSizes(output, doc)
+
+	output, err = run("pdftotext", "-enc", "UTF-8", filename, "-")
+	if err != nil {
+		return nil, err
+	}
+	// pdftotext ends every page with a form feed.
+	for i, text := range strings.Split(string(output), "\f") {
+		if i < count {
+			doc.Pages[i].Text = strings.TrimSpace(text)
+		}
+	}
+
+	return doc, nil
+}
+
+// Terms splits text into lower-case terms for the search index and counts
+// how often each term occurs. Terms that are shorter than two characters are
+// dropped.
+func Terms(text string) map[string]int {
+	terms := make(map[string]int)
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		term := strings.ToLower(word)
+		if utf8.RuneCountInString(term) < 2 {
+			continue
+		}
+		if len(term) > MaxTermLength {
+			// Cut at the last rune boundary within the limit.
+			end := MaxTermLength
+			for !utf8.RuneStart(term[end]) {
+				end--
+			}
+			term = term[:end]
+		}
+		terms[term]++
+	}
+	return terms
+}
+
+func run(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s failed: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+func parsePageCount(output []byte) (int, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Pages:") {
+			return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Pages:")))
+		}
+	}
+	return 0, fmt.Errorf("pdfinfo didn't report the number of pages")
+}
+
+// parsePageSizes parses the "Page N size" and "Page N rot" lines that
+// pdfinfo prints for a range of pages.
+func parsePageSizes(output []byte, doc *Document) {
+	rotated := make(map[int]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		var (
+			number, rotation int
+			width, height    float64
+		)
+		line := scanner.Text()
+		if _, err := fmt.Sscanf(line, "Page %d size: %f x %f", &number, &width, &height); err == nil {
+			if number >= 1 && number <= len(doc.Pages) {
+				doc.Pages[number-1].Width, doc.Pages[number-1].Height = width, height
+			}
+		} else if _, err := fmt.Sscanf(line, "Page %d rot: %d", &number, &rotation); err == nil {
+			rotated[number] = rotation%180 != 0
+		}
+	}
+
+	for _, page := range doc.Pages {
+		if rotated[page.Number] {
+			page.Width, page.Height = page.Height, page.Width
+		}
+	}
+}
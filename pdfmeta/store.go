@@ -0,0 +1,33 @@
+package pdfmeta
+
+import (
+	"database/sql"
+)
+
+// Store records the page count and the metadata of all pages of an upload,
+// identified by its uploadID, and adds the text of the pages to the search
+// index. It replaces any metadata that was stored for the upload before.
+func Store(tx *sql.Tx, uploadID int, doc *Document) error {
+	if _, err := tx.Exec("UPDATE uploads SET pages = ? WHERE id = ?", len(doc.Pages), uploadID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM upload_pages WHERE upload_id = ?", uploadID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM search_terms WHERE upload_id = ?", uploadID); err != nil {
+		return err
+	}
+	for _, page := range doc.Pages {
+		if _, err := tx.Exec("INSERT INTO upload_pages (upload_id, page, width, height, text) VALUES (?, ?, ?, ?, ?)",
+			uploadID, page.Number, page.Width, page.Height, page.Text); err != nil {
+			return err
+		}
+		for term, occurrences := range Terms(page.Text) {
+			if _, err := tx.Exec("INSERT INTO search_terms (upload_id, page, term, occurrences) VALUES (?, ?, ?, ?)",
+				uploadID, page.Number, term, occurrences); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+// Errors returned by Store.VotePoll.
+var (
+	ErrPollClosed        = errors.New("poll is closed")
+	ErrInvalidPollOption = errors.New("invalid poll option")
+	ErrAlreadyVoted      = errors.New("viewer already voted")
+)
+
+const (
+	// maxPollOptions is the maximum number of options of a poll.
+	maxPollOptions = 10
+
+	// maxPollOptionLength is the maximum number of characters of a poll option.
+	maxPollOptionLength = 200
+)
+
+// Poll describes a poll that a presenter started during a session. Results
+// holds the number of votes for each option.
+type Poll struct {
+	ID          int       `meddler:"id,pk" json:"id"`
+	SessionID   int       `meddler:"session_id" json:"-"`
+	PresenterID int       `meddler:"presenter_id" json:"presenter,omitempty"`
+	Question    string    `meddler:"question" json:"question"`
+	Options     []string  `meddler:"options,json" json:"options"`
+	Started     time.Time `meddler:"started,utctimez" json:"started"`
+	Closed      time.Time `meddler:"closed,utctimez" json:"-"`
+	Open        bool      `meddler:"-" json:"open"`
+	Results     []int     `meddler:"-" json:"results"`
+}
+
+// pollMessage is sent by presenters to start (startPoll) and close
+// (closePoll) polls, and by viewers to vote (votePoll).
+type pollMessage struct {
+	Cmd      string   `json:"cmd"`
+	PollID   int      `json:"poll_id"`
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+	Option   int      `json:"option"`
+}
+
+// isPollCommand returns whether cmd is a command that presenters use to
+// control polls.
+func isPollCommand(cmd string) bool {
+	return cmd == "startPoll" || cmd == "closePoll"
+}
+
+// controlPoll starts or closes a poll on behalf of a presenter, identified
+// by userID.
+func controlPoll(msg *pollMessage, sessionID, userID int, dbStore Store, broker Broker) error {
+	var poll *Poll
+	var err error
+
+	switch msg.Cmd {
+	case "startPoll":
+		if poll, err = newPoll(msg, sessionID, userID); err != nil {
+			return err
+		}
+		StatCount("poll started", 1)
+		err = dbStore.InsertPoll(poll)
+	case "closePoll":
+		StatCount("poll closed", 1)
+		poll, err = dbStore.ClosePoll(sessionID, msg.PollID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return publishPoll(sessionID, poll, broker)
+}
+
+func newPoll(msg *pollMessage, sessionID, userID int) (*Poll, error) {
+	question := strings.TrimSpace(msg.Question)
+	if question == "" || utf8.RuneCountInString(question) > maxQuestionLength {
+		return nil, errors.New("poll question is empty or too long")
+	}
+
+	if len(msg.Options) < 2 || len(msg.Options) > maxPollOptions {
+		return nil, errors.New("invalid number of poll options")
+	}
+
+	options := make([]string, 0, len(msg.Options))
+	for _, option := range msg.Options {
+		option = strings.TrimSpace(option)
+		if option == "" || utf8.RuneCountInString(option) > maxPollOptionLength {
+			return nil, errors.New("poll option is empty or too long")
+		}
+		options = append(options, option)
+	}
+
+	return &Poll{
+		SessionID:   sessionID,
+		PresenterID: userID,
+		Question:    question,
+		Options:     options,
+		Started:     time.Now().UTC(),
+	}, nil
+}
+
+// votePoll records the vote of a viewer.
+func votePoll(msg *pollMessage, sessionID int, viewerID string, dbStore Store, broker Broker) error {
+	poll, err := dbStore.VotePoll(sessionID, msg.PollID, viewerID, msg.Option)
+	if err != nil {
+		return err
+	}
+
+	StatCount("poll vote", 1)
+	return publishPoll(sessionID, poll, broker)
+}
+
+// publishPoll announces a new poll or its changed results to everybody in
+// the session. Like questions, polls aren't sequenced.
+func publishPoll(sessionID int, poll *Poll, broker Broker) error {
+	return broker.Publish(sessionID, &Command{
+		Cmd:       "pollResults",
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		Poll:      poll,
+	})
+}
+
+// GetPollsHandler returns the polls of a session with their results.
+type GetPollsHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *GetPollsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	StatCount("get polls", 1)
+
+	sessionID, err := authorizeViewer(r, r.URL.Query().Get(":id"), h.DBStore, h.SessionStore, h.SecureCookie)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+
+	result, err := h.DBStore.GetPolls(sessionID)
+	if err != nil {
+		xlog.Errorf("Querying polls of session %d failed: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// ExportPollsHandler delivers the results of all polls of a session as CSV,
+// with one line per poll option.
+type ExportPollsHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+}
+
+func (h *ExportPollsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("export polls", 1)
+
+	publicID := r.URL.Query().Get(":id")
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(publicID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if ownerID != userID {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	polls, err := h.DBStore.GetPolls(sessionID)
+	if err != nil {
+		xlog.Errorf("Querying polls of session %d failed: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": publicID + "-polls.csv"}))
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"poll", "question", "started", "closed", "option", "votes"})
+	for i, poll := range polls {
+		closed := ""
+		if !poll.Closed.IsZero() {
+			closed = poll.Closed.Format(time.RFC3339)
+		}
+		for j, option := range poll.Options {
+			out.Write([]string{strconv.Itoa(i + 1), poll.Question, poll.Started.Format(time.RFC3339), closed, option, strconv.Itoa(poll.Results[j])})
+		}
+	}
+	out.Flush()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+// ErrUnknownAccount is returned by Store.AddPresenter if no user has
+// connected the requested account.
+var ErrUnknownAccount = errors.New("unknown account")
+
+// Presenter describes a co-presenter of a session. Co-presenters may send
+// commands just like the owner of the session, but can't stop it.
+type Presenter struct {
+	UserID   int       `meddler:"user_id" json:"user_id"`
+	Added    time.Time `meddler:"added,utctimez" json:"added"`
+	Accounts []string  `meddler:"-" json:"accounts"`
+}
+
+// canPresent returns whether a user may send commands to a session.
+func canPresent(dbStore Store, ownerID, sessionID, userID int) bool {
+	if userID == ownerID {
+		return true
+	}
+
+	isPresenter, err := dbStore.IsPresenter(sessionID, userID)
+	if err != nil {
+		xlog.Errorf("Checking whether user %d presents session %d failed: %v", userID, sessionID, err)
+		return false
+	}
+	return isPresenter
+}
+
+// AddPresenterHandler invites a co-presenter, identified by one of their
+// connected accounts, to a session.
+type AddPresenterHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *AddPresenterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if session.Values["userID"] == nil {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("add presenter", 1)
+
+	requestData := struct {
+		PublicID string `json:"session_id"`
+		Account  string `json:"account"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(requestData.PublicID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ownerID != session.Values["userID"].(int) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	presenter, err := h.DBStore.AddPresenter(sessionID, requestData.Account)
+	if err == ErrUnknownAccount {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		xlog.Errorf("Adding presenter %s to session %s failed: %v", requestData.Account, requestData.PublicID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presenter)
+}
+
+// DeletePresenterHandler revokes the rights of a co-presenter.
+type DeletePresenterHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *DeletePresenterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if session.Values["userID"] == nil {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("delete presenter", 1)
+
+	requestData := struct {
+		PublicID string `json:"session_id"`
+		UserID   int    `json:"user_id"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(requestData.PublicID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ownerID != session.Values["userID"].(int) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.DBStore.RemovePresenter(sessionID, requestData.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetPresentersHandler returns the co-presenters of a session.
+type GetPresentersHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+}
+
+func (h *GetPresentersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("get presenters", 1)
+
+	ownerID, sessionID, err := h.DBStore.GetOwnerForSession(r.URL.Query().Get(":id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !canPresent(h.DBStore, ownerID, sessionID, userID) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := h.DBStore.GetPresenters(sessionID)
+	if err != nil {
+		xlog.Errorf("Querying presenters of session %d failed: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
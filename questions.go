@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+// States of a question. New questions are open until a presenter approves
+// them; only approved and answered questions are shown to the audience.
+const (
+	QuestionOpen     = "open"
+	QuestionApproved = "approved"
+	QuestionAnswered = "answered"
+	QuestionHidden   = "hidden"
+)
+
+const (
+	// maxQuestionLength is the maximum number of characters of a question.
+	maxQuestionLength = 1000
+
+	// maxQuestionsPerViewer is the number of questions a viewer may ask per
+	// questionWindow in a session.
+	maxQuestionsPerViewer = 5
+	questionWindow        = time.Minute
+)
+
+var questionLimiter = newRateLimiter(maxQuestionsPerViewer, questionWindow)
+
+// Question describes a question that a viewer asked during a session.
+type Question struct {
+	ID        int       `meddler:"id,pk" json:"id"`
+	SessionID int       `meddler:"session_id" json:"-"`
+	ViewerID  string    `meddler:"viewer_id" json:"-"`
+	Text      string    `meddler:"text" json:"text"`
+	Asked     time.Time `meddler:"asked,utctimez" json:"asked"`
+	State     string    `meddler:"state" json:"state"`
+	Votes     int       `meddler:"votes" json:"votes"`
+}
+
+// Public returns whether the audience may see a question.
+func (q *Question) Public() bool {
+	return q.State == QuestionApproved || q.State == QuestionAnswered
+}
+
+// questionMessage is sent by viewers to ask questions (askQuestion) and to
+// upvote them (upvoteQuestion), and by presenters to moderate them
+// (approveQuestion, answerQuestion, hideQuestion, reopenQuestion).
+type questionMessage struct {
+	Cmd        string `json:"cmd"`
+	QuestionID int    `json:"question_id"`
+	Text       string `json:"text"`
+}
+
+// viewerID returns a stable identifier for the viewer behind a request, or
+// an empty string if the viewer has none yet. Signed-in users are identified
+// by their userID, anonymous viewers by the ID in their viewer cookie.
+func viewerID(r *http.Request, sessionStore sessions.Store, secureCookie *securecookie.SecureCookie) string {
+	if session, err := sessionStore.Get(r, SESSIONNAME); err == nil {
+		if userID, ok := session.Values["userID"].(int); ok {
+			return fmt.Sprintf("user:%d", userID)
+		}
+	}
+
+	if cookie, err := r.Cookie(VIEWERID); err == nil {
+		var id string
+		if err := secureCookie.Decode(VIEWERID, cookie.Value, &id); err == nil && id != "" {
+			return "anon:" + id
+		}
+	}
+
+	return ""
+}
+
+// ensureViewerID issues a new viewer cookie unless the request already
+// carries a valid one.
+func ensureViewerID(w http.ResponseWriter, r *http.Request, secureCookie *securecookie.SecureCookie) {
+	if cookie, err := r.Cookie(VIEWERID); err == nil {
+		var id string
+		if err := secureCookie.Decode(VIEWERID, cookie.Value, &id); err == nil {
+			return
+		}
+	}
+
+	value, err := secureCookie.Encode(VIEWERID, generateID())
+	if err != nil {
+		xlog.Errorf("Encoding viewer ID failed: %v", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: VIEWERID, Value: value, Path: "/", HttpOnly: true, Expires: time.Now().Add(30 * 24 * time.Hour)})
+}
+
+// handleQuestionMessage lets a viewer ask or upvote a question.
+func handleQuestionMessage(msg *questionMessage, sessionID int, viewerID string, dbStore Store, broker Broker) error {
+	var question *Question
+	var err error
+
+	switch msg.Cmd {
+	case "askQuestion":
+		text := strings.TrimSpace(msg.Text)
+		if text == "" || utf8.RuneCountInString(text) > maxQuestionLength {
+			return errors.New("question is empty or too long")
+		}
+
+		if !questionLimiter.Allow(fmt.Sprintf("%d:%s", sessionID, viewerID)) {
+			StatCount("question throttled", 1)
+			return errors.New("too many questions")
+		}
+
+		StatCount("question asked", 1)
+		question = &Question{
+			SessionID: sessionID,
+			ViewerID:  viewerID,
+			Text:      text,
+			Asked:     time.Now().UTC(),
+			State:     QuestionOpen,
+		}
+		err = dbStore.InsertQuestion(question)
+	case "upvoteQuestion":
+		StatCount("question upvoted", 1)
+		question, err = dbStore.UpvoteQuestion(sessionID, msg.QuestionID, viewerID)
+	default:
+		return fmt.Errorf("unknown command %s", msg.Cmd)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return publishQuestion(sessionID, question, broker)
+}
+
+// isModerationCommand returns whether cmd is a command that presenters use
+// to moderate questions.
+func isModerationCommand(cmd string) bool {
+	switch cmd {
+	case "approveQuestion", "answerQuestion", "hideQuestion", "reopenQuestion":
+		return true
+	}
+	return false
+}
+
+// moderateQuestion changes the state of a question on behalf of a presenter.
+// Reopening an answered or hidden question shows it to the audience again.
+func moderateQuestion(msg *questionMessage, sessionID int, dbStore Store, broker Broker) error {
+	state := QuestionApproved
+	switch msg.Cmd {
+	case "answerQuestion":
+		state = QuestionAnswered
+	case "hideQuestion":
+		state = QuestionHidden
+	}
+
+	StatCount("question moderated", 1)
+	question, err := dbStore.SetQuestionState(sessionID, msg.QuestionID, state)
+	if err != nil {
+		return err
+	}
+
+	return publishQuestion(sessionID, question, broker)
+}
+
+// publishQuestion announces a new or changed question to the presenters of
+// the session; viewers get what viewerCommand lets through. Question updates
+// don't change the slides, so they aren't sequenced.
+func publishQuestion(sessionID int, question *Question, broker Broker) error {
+	return broker.Publish(sessionID, &Command{
+		Cmd:       "question",
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+		Question:  question,
+	})
+}
+
+// viewerCommand returns the command that viewers get for a command published
+// in a session, or nil if they mustn't get it. Open questions wait for
+// moderation and are only sent to presenters. For hidden questions, viewers
+// only learn the new state, so that they can remove them.
+func viewerCommand(cmd *Command) *Command {
+	if cmd.Cmd != "question" || cmd.Question == nil || cmd.Question.Public() {
+		return cmd
+	}
+
+	if cmd.Question.State != QuestionHidden {
+		return nil
+	}
+
+	redacted := *cmd
+	redacted.Question = &Question{ID: cmd.Question.ID, State: cmd.Question.State}
+	return &redacted
+}
+
+// GetQuestionsHandler returns the questions of a session. Presenters also
+// get the questions that are waiting for moderation or that they've hidden.
+type GetQuestionsHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *GetQuestionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	StatCount("get questions", 1)
+
+	publicID := r.URL.Query().Get(":id")
+
+	sessionID, err := authorizeViewer(r, publicID, h.DBStore, h.SessionStore, h.SecureCookie)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+
+	all := false
+	if session, err := h.SessionStore.Get(r, SESSIONNAME); err == nil {
+		if userID, ok := session.Values["userID"].(int); ok {
+			ownerID, _, err := h.DBStore.GetOwnerForSession(publicID)
+			all = err == nil && canPresent(h.DBStore, ownerID, sessionID, userID)
+		}
+	}
+
+	result, err := h.DBStore.GetQuestions(sessionID, all)
+	if err != nil {
+		xlog.Errorf("Querying questions of session %d failed: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter counts events per key, e.g. failed passcode attempts per
+// client, and tells when a key has reached its limit within a fixed window.
+// It only keeps state in memory, so every satsuma instance limits on its own.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mtx       sync.Mutex
+	counts    map[string]*rateCount
+	lastPrune time.Time
+}
+
+type rateCount struct {
+	n     int
+	start time.Time
+}
+
+// newRateLimiter creates a rateLimiter that allows limit events per key
+// within window.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counts: make(map[string]*rateCount)}
+}
+
+// Limited returns whether key has reached its limit.
+func (l *rateLimiter) Limited(key string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	c := l.counts[key]
+	return c != nil && time.Since(c.start) < l.window && c.n >= l.limit
+}
+
+// Add counts an event for key.
+func (l *rateLimiter) Add(key string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > l.window {
+		for k, c := range l.counts {
+			if now.Sub(c.start) >= l.window {
+				delete(l.counts, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	c := l.counts[key]
+	if c == nil || now.Sub(c.start) >= l.window {
+		c = &rateCount{start: now}
+		l.counts[key] = c
+	}
+	c.n++
+}
+
+// Allow counts an event for key and returns whether it is within the limit.
+func (l *rateLimiter) Allow(key string) bool {
+	if l.Limited(key) {
+		return false
+	}
+	l.Add(key)
+	return true
+}
+
+// trustedProxies are the networks of the reverse proxies in front of
+// satsuma. For requests from them, clientAddr takes the client address from
+// the X-Forwarded-For header.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the trusted proxies from a comma-separated list of
+// IP addresses and CIDR ranges.
+func SetTrustedProxies(list string) error {
+	trustedProxies = nil
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the IP address of the client of a request. Behind
+// trusted proxies, this is the last address in X-Forwarded-For that isn't a
+// trusted proxy itself; anything before it could be forged by the client.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(host); i-- {
+		if addr := strings.TrimSpace(forwarded[i]); addr != "" {
+			host = addr
+		}
+	}
+	return host
+}
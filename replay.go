@@ -0,0 +1,191 @@
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+	"strings"
+	"time"
+)
+
+// SessionRecording contains everything that is needed to replay a session.
+type SessionRecording struct {
+	Started     time.Time  `meddler:"started,utctimez"`
+	Ended       time.Time  `meddler:"ended,utctimez"`
+	PeakViewers int        `meddler:"peak_viewers"`
+	Cmds        []*Command `meddler:"-"`
+}
+
+// ReplayState describes the state of a replay. It is sent to the client when
+// the replay starts, whenever the client changed it and when the replay
+// reaches the end. Offset and Duration are in milliseconds.
+type ReplayState struct {
+	Cmd      string  `json:"cmd"`
+	Offset   int64   `json:"offset"`
+	Duration int64   `json:"duration"`
+	Playing  bool    `json:"playing"`
+	Speed    float64 `json:"speed"`
+}
+
+// replayControl is sent by the client to control the replay. Action is one of
+// play, pause, seek (to Offset milliseconds) and speed.
+type replayControl struct {
+	Action string  `json:"action"`
+	Offset int64   `json:"offset"`
+	Speed  float64 `json:"speed"`
+}
+
+const (
+	minReplaySpeed = 0.25
+	maxReplaySpeed = 16
+)
+
+// ReplayHandler streams the commands of a stopped session, identified by the
+// last element of the request path, with their original relative timing.
+func ReplayHandler(s *websocket.Conn, dbStore Store, sessionStore sessions.Store, secureCookie *securecookie.SecureCookie) {
+	StatCount("replay", 1)
+	publicID := strings.TrimPrefix(s.Request().URL.Path, "/api/replay/")
+
+	sessionID, err := authorizeViewer(s.Request(), publicID, dbStore, sessionStore, secureCookie)
+	if err != nil {
+		xlog.Infof("ReplayHandler: viewer rejected: %v", err)
+		return
+	}
+
+	recording, err := dbStore.GetSessionRecording(sessionID)
+	if err != nil {
+		xlog.Errorf("ReplayHandler: getting recording of session %d failed: %v", sessionID, err)
+		return
+	}
+
+	if recording.Ended.IsZero() {
+		xlog.Infof("ReplayHandler: session %s hasn't ended yet", publicID)
+		return
+	}
+
+	controls := make(chan replayControl)
+	go func() {
+		defer close(controls)
+		for {
+			var ctl replayControl
+			if err := websocket.JSON.Receive(s, &ctl); err != nil {
+				return
+			}
+			controls <- ctl
+		}
+	}()
+
+	if err := replay(s, recording, controls); err != nil {
+		xlog.Errorf("ReplayHandler: replaying session %s failed: %v", publicID, err)
+	}
+
+	// drain the control channel so that the receiving goroutine can finish.
+	s.Close()
+	for range controls {
+	}
+}
+
+// replay plays back a recording until controls is closed.
+func replay(s *websocket.Conn, recording *SessionRecording, controls <-chan replayControl) error {
+	cmds := recording.Cmds
+	duration := recording.Ended.Sub(recording.Started)
+	offsetOf := func(cmd *Command) time.Duration {
+		return cmd.Timestamp.Sub(recording.Started)
+	}
+
+	state := ReplayState{Cmd: "replayState", Duration: int64(duration / time.Millisecond), Playing: true, Speed: 1}
+	offset := time.Duration(0)
+	next := 0
+
+	sendState := func() error {
+		state.Offset = int64(offset / time.Millisecond)
+		return websocket.JSON.Send(s, state)
+	}
+
+	if err := sendState(); err != nil {
+		return err
+	}
+
+	for {
+		var timer <-chan time.Time
+		resumed := time.Now()
+		if state.Playing {
+			target := duration
+			if next < len(cmds) {
+				target = offsetOf(cmds[next])
+			}
+			timer = time.After(time.Duration(float64(target-offset) / state.Speed))
+		}
+
+		select {
+		case <-timer:
+			if next == len(cmds) {
+				offset = duration
+				state.Playing = false
+				if err := sendState(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			offset = offsetOf(cmds[next])
+			if err := websocket.JSON.Send(s, cmds[next]); err != nil {
+				return err
+			}
+			next++
+		case ctl, ok := <-controls:
+			if !ok {
+				return nil
+			}
+
+			if state.Playing {
+				offset += time.Duration(float64(time.Since(resumed)) * state.Speed)
+				if next < len(cmds) && offset > offsetOf(cmds[next]) {
+					offset = offsetOf(cmds[next])
+				}
+			}
+
+			switch ctl.Action {
+			case "play":
+				state.Playing = true
+				if offset >= duration {
+					offset, next = 0, 0
+					if err := websocket.JSON.Send(s, buildSnapshot(0, nil)); err != nil {
+						return err
+					}
+				}
+			case "pause":
+				state.Playing = false
+			case "speed":
+				if ctl.Speed >= minReplaySpeed && ctl.Speed <= maxReplaySpeed {
+					state.Speed = ctl.Speed
+				}
+			case "seek":
+				offset = time.Duration(ctl.Offset) * time.Millisecond
+				if offset < 0 {
+					offset = 0
+				} else if offset > duration {
+					offset = duration
+				}
+
+				next = 0
+				for next < len(cmds) && offsetOf(cmds[next]) <= offset {
+					next++
+				}
+
+				seq := 0
+				if next > 0 {
+					seq = cmds[next-1].Seq
+				}
+				if err := websocket.JSON.Send(s, buildSnapshot(seq, cmds[:next])); err != nil {
+					return err
+				}
+			}
+
+			if err := sendState(); err != nil {
+				return err
+			}
+		}
+	}
+}
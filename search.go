@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/satsuma/pdfmeta"
+	"github.com/joinmytalk/xlog"
+)
+
+const (
+	maxSearchTerms   = 10
+	maxSearchResults = 50
+)
+
+// SearchMatch describes a page of an upload that matches a search.
+type SearchMatch struct {
+	UploadID string `meddler:"public_id"`
+	Title    string `meddler:"title"`
+	Page     int    `meddler:"page"`
+	Score    int    `meddler:"score"`
+}
+
+// SearchResult describes an upload that matches a search. Pages holds the
+// matching pages, the best match first.
+type SearchResult struct {
+	UploadID string `json:"id"`
+	Title    string `json:"title"`
+	Score    int    `json:"score"`
+	Pages    []int  `json:"pages"`
+}
+
+// rankSearchMatches groups matching pages by upload. The score of an upload
+// is the sum of the scores of its pages. matches must be ordered by score.
+func rankSearchMatches(matches []*SearchMatch) []*SearchResult {
+	results := []*SearchResult{}
+	byUpload := make(map[string]*SearchResult)
+
+	for _, match := range matches {
+		result := byUpload[match.UploadID]
+		if result == nil {
+			result = &SearchResult{UploadID: match.UploadID, Title: match.Title, Pages: []int{}}
+			byUpload[match.UploadID] = result
+			results = append(results, result)
+		}
+		result.Score += match.Score
+		result.Pages = append(result.Pages, match.Page)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+
+	return results
+}
+
+// SearchHandler searches the text of the current user's uploads.
+type SearchHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+}
+
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Debugf("Getting session failed: %v", err)
+		StatCount("getting session failed", 1)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	StatCount("search uploads", 1)
+
+	terms := []string{}
+	for term := range pdfmeta.Terms(r.URL.Query().Get("q")) {
+		terms = append(terms, term)
+	}
+
+	if len(terms) > maxSearchTerms {
+		http.Error(w, "too many search terms", http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.DBStore.SearchUploads(userID, terms)
+	if err != nil {
+		xlog.Errorf("Searching uploads of user %d failed: %v", userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
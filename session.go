@@ -2,11 +2,10 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"time"
 
-	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/joinmytalk/xlog"
@@ -21,7 +20,7 @@ type Session struct {
 }
 
 type StartSessionHandler struct {
-	DBStore      *Store
+	DBStore      Store
 	SessionStore sessions.Store
 	SecureCookie *securecookie.SecureCookie
 }
@@ -48,6 +47,7 @@ func (h *StartSessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	data := struct {
 		UploadID string `json:"upload_id"`
+		sessionAccessRequest
 	}{}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
@@ -56,6 +56,12 @@ func (h *StartSessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	access, err := data.apply(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	uploadEntry, err := h.DBStore.GetUploadByPublicID(data.UploadID, session.Values["userID"].(int))
 	if err != nil {
 		xlog.Errorf("Querying upload %s failed: %v", data.UploadID, err)
@@ -65,32 +71,45 @@ func (h *StartSessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	id := generateID()
 
-	if err := h.DBStore.InsertSession(&Session{
+	sess := &Session{
 		UploadID: uploadEntry.ID,
 		PublicID: id,
 		Started:  time.Now().UTC(),
-	}); err != nil {
+	}
+	if err := h.DBStore.InsertSession(sess); err != nil {
 		xlog.Errorf("Insert failed: %v", err)
 		http.Error(w, "insert failed", http.StatusInternalServerError)
 		return
 	}
 
+	if access.Visibility != VisibilityPublic {
+		if err := h.DBStore.SetSessionAccess(sess.ID, access); err != nil {
+			xlog.Errorf("Setting access of session %s failed: %v", id, err)
+			h.DBStore.DeleteSession(id)
+			http.Error(w, "insert failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"id": id})
 }
 
 // SessionData is used by Store.GetSessions
 type SessionData struct {
-	PublicID  string    `meddler:"public_id" json:"id"`
-	Title     string    `meddler:"title" json:"title"`
-	Started   time.Time `meddler:"started,utctimez" json:"started"`
-	Ended     time.Time `meddler:"ended,utctimez" json:"-"`
-	EndedJSON string    `meddler:"-" json:"ended,omitempty"`
+	PublicID   string    `meddler:"public_id" json:"id"`
+	Title      string    `meddler:"title" json:"title"`
+	Started    time.Time `meddler:"started,utctimez" json:"started"`
+	Ended      time.Time `meddler:"ended,utctimez" json:"-"`
+	EndedJSON  string    `meddler:"-" json:"ended,omitempty"`
+	UploadID   string    `meddler:"upload_id" json:"-"`
+	ThumbCount int       `meddler:"thumbnails" json:"-"`
+	Preview    string    `meddler:"-" json:"preview,omitempty"`
 }
 
 type GetSessionsHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
 }
 
 func (h *GetSessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -117,24 +136,36 @@ func (h *GetSessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, entry := range result {
+		_, entry.Preview = ThumbnailURLs(entry.UploadID, entry.ThumbCount)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
 type SessionInfo struct {
-	Title     string     `meddler:"title" json:"title"`
-	UploadID  string     `meddler:"public_id" json:"upload_id"`
-	IsOwner   bool       `json:"owner" meddler:"-"`
-	UserID    int        `meddler:"user_id" json:"-"`
-	Page      int        `meddler:"page" json:"page"`
-	Ended     time.Time  `meddler:"ended,utctimez" json:"-"`
-	EndedJSON string     `meddler:"-" json:"ended,omitempty"`
-	Cmds      []*Command `meddler:"-" json:"cmds"`
+	Title        string       `meddler:"title" json:"title"`
+	UploadID     string       `meddler:"public_id" json:"upload_id"`
+	IsOwner      bool         `json:"owner" meddler:"-"`
+	IsPresenter  bool         `json:"presenter" meddler:"-"`
+	UserID       int          `meddler:"user_id" json:"-"`
+	Page         int          `meddler:"page" json:"page"`
+	Ended        time.Time    `meddler:"ended,utctimez" json:"-"`
+	EndedJSON    string       `meddler:"-" json:"ended,omitempty"`
+	Visibility   string       `meddler:"visibility" json:"visibility"`
+	Viewers      int          `meddler:"-" json:"viewers"`
+	PeakViewers  int          `meddler:"peak_viewers" json:"peak_viewers"`
+	PublishNotes bool         `meddler:"publish_notes" json:"publish_notes"`
+	Notes        []*SlideNote `meddler:"-" json:"notes,omitempty"`
+	Cmds         []*Command   `meddler:"-" json:"cmds"`
 }
 
 type GetSessionInfoHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+	Broker       Broker
 }
 
 func (h *GetSessionInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -154,6 +185,12 @@ func (h *GetSessionInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 
 	publicID := r.URL.Query().Get(":id")
 
+	sessionID, err := authorizeViewer(r, publicID, h.DBStore, h.SessionStore, h.SecureCookie)
+	if err != nil {
+		writeAccessError(w, err)
+		return
+	}
+
 	result, err := h.DBStore.GetSessionInfoByPublicID(publicID, userID)
 	if err != nil {
 		xlog.Errorf("Loading session information failed: %v", err)
@@ -161,15 +198,30 @@ func (h *GetSessionInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if result.EndedJSON == "" {
+		if result.Viewers, err = h.Broker.CountViewers(sessionID); err != nil {
+			xlog.Errorf("Counting viewers of session %d failed: %v", sessionID, err)
+		}
+		if result.Viewers > result.PeakViewers {
+			result.PeakViewers = result.Viewers
+		}
+	}
+
+	// anonymous viewers need an ID to ask questions.
+	ensureViewerID(w, r, h.SecureCookie)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
+// ErrSessionEnded is returned when stopping a session that has already ended.
+var ErrSessionEnded = errors.New("session has already ended")
+
 type StopSessionHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
 	SecureCookie *securecookie.SecureCookie
-	RedisAddr    string
+	Broker       Broker
 }
 
 func (h *StopSessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -212,30 +264,36 @@ func (h *StopSessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.DBStore.StopSession(requestData.PublicID)
-
-	w.WriteHeader(http.StatusNoContent)
-
-	c, err := redis.Dial("tcp", h.RedisAddr)
+	viewers, err := h.Broker.CountViewers(sessionID)
 	if err != nil {
-		xlog.Errorf("redis.Dial failed: %v", err)
+		xlog.Errorf("Counting viewers of session %d failed: %v", sessionID, err)
+	}
+
+	if err := h.DBStore.StopSession(requestData.PublicID, viewers); err == ErrSessionEnded {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		xlog.Errorf("Stopping session %s failed: %v", requestData.PublicID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer c.Close()
 
-	cmdJSON, _ := json.Marshal(&Command{
+	w.WriteHeader(http.StatusNoContent)
+
+	// like questions, the close command is unsequenced; viewers that connect
+	// later learn about the end from the session's snapshot.
+	if err := h.Broker.Publish(sessionID, &Command{
 		Cmd:       "close",
 		SessionID: sessionID,
 		Timestamp: time.Now(),
-	})
-
-	c.Send("PUBLISH", fmt.Sprintf("session.%d", sessionID), string(cmdJSON))
-	c.Flush()
+	}); err != nil {
+		xlog.Errorf("Publishing close command for session %d failed: %v", sessionID, err)
+	}
 }
 
 type DeleteSessionHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
 	SecureCookie *securecookie.SecureCookie
 }
 
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joinmytalk/satsuma/thumbnails"
+	"github.com/joinmytalk/xlog"
+)
+
+const (
+	siteName = "Join my Talk!"
+
+	defaultEmbedWidth = 800
+	// embedToolbarHeight is the height that the embedded player needs in
+	// addition to the slide.
+	embedToolbarHeight = 60
+)
+
+// SessionSummary contains what is needed to describe a session in shared
+// links. Width and height are the size of the first page in points, or 0 if
+// unknown.
+type SessionSummary struct {
+	Title      string    `meddler:"title"`
+	UploadID   string    `meddler:"upload_id"`
+	ThumbCount int       `meddler:"thumbnails"`
+	Started    time.Time `meddler:"started,utctimez"`
+	Ended      time.Time `meddler:"ended,utctimez"`
+	Visibility string    `meddler:"visibility"`
+	Width      float64   `meddler:"width"`
+	Height     float64   `meddler:"height"`
+}
+
+// Description returns a short description of the session's state.
+func (summary *SessionSummary) Description() string {
+	if summary.Ended.IsZero() {
+		return "Live presentation on " + siteName
+	}
+	return "Presentation on " + siteName + ", ended " + summary.Ended.Format("January 2, 2006")
+}
+
+// aspectRatio returns the ratio of height to width of the slides, assuming
+// 4:3 if the size of the slides is unknown.
+func (summary *SessionSummary) aspectRatio() float64 {
+	if summary.Width > 0 && summary.Height > 0 {
+		return summary.Height / summary.Width
+	}
+	return 0.75
+}
+
+// embedSize returns the size of the embedded player, given the maximum
+// width and height requested by an oEmbed consumer, 0 meaning no limit.
+func (summary *SessionSummary) embedSize(maxWidth, maxHeight int) (width, height int) {
+	ratio := summary.aspectRatio()
+
+	width = defaultEmbedWidth
+	if maxWidth > 0 && maxWidth < width {
+		width = maxWidth
+	}
+	height = int(float64(width)*ratio) + embedToolbarHeight
+	if maxHeight > embedToolbarHeight && height > maxHeight {
+		height = maxHeight
+		width = int(float64(height-embedToolbarHeight) / ratio)
+	}
+	return width, height
+}
+
+// publicBaseURL returns the URL under which satsuma is reachable, without a
+// trailing slash. Unless it is configured, it is derived from the request.
+func publicBaseURL(configured string, r *http.Request) string {
+	if configured != "" {
+		return strings.TrimSuffix(configured, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+var sessionMetaTemplate = template.Must(template.New("meta").Parse(`
+		<meta property="og:type" content="website">
+		<meta property="og:site_name" content="{{.SiteName}}">
+		<meta property="og:title" content="{{.Title}}">
+		<meta property="og:description" content="{{.Description}}">
+		<meta property="og:url" content="{{.URL}}">
+		{{if .Image}}<meta property="og:image" content="{{.Image}}">
+		{{end}}<meta name="twitter:card" content="{{if .Image}}summary_large_image{{else}}summary{{end}}">
+		<meta name="twitter:title" content="{{.Title}}">
+		<meta name="twitter:description" content="{{.Description}}">
+		{{if .Image}}<meta name="twitter:image" content="{{.Image}}">
+		{{end}}<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">
+	`))
+
+// SessionPageHandler delivers index.html for a session. For public sessions,
+// it adds Open Graph and Twitter Card metadata so that shared links to the
+// session get a proper preview.
+type SessionPageHandler struct {
+	DBStore   Store
+	HtdocsDir string
+	BaseURL   string
+}
+
+func (h *SessionPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	index, err := ioutil.ReadFile(path.Join(h.HtdocsDir, "index.html"))
+	if err != nil {
+		xlog.Errorf("Reading index.html failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	summary, err := h.DBStore.GetSessionSummary(path.Base(r.URL.Path))
+	if err != nil || summary.Visibility != VisibilityPublic {
+		w.Write(index)
+		return
+	}
+
+	StatCount("session page with metadata", 1)
+
+	baseURL := publicBaseURL(h.BaseURL, r)
+	sessionURL := baseURL + "/s/" + path.Base(r.URL.Path)
+	_, preview := ThumbnailURLs(summary.UploadID, summary.ThumbCount)
+	if preview != "" {
+		preview = baseURL + preview
+	}
+
+	var meta bytes.Buffer
+	err = sessionMetaTemplate.Execute(&meta, map[string]string{
+		"SiteName":    siteName,
+		"Title":       summary.Title,
+		"Description": summary.Description(),
+		"URL":         sessionURL,
+		"Image":       preview,
+		"OEmbedURL":   baseURL + "/oembed?format=json&url=" + url.QueryEscape(sessionURL),
+	})
+	if err != nil {
+		xlog.Errorf("Rendering session metadata failed: %v", err)
+		w.Write(index)
+		return
+	}
+
+	w.Write(bytes.Replace(index, []byte("</head>"), append(meta.Bytes(), []byte("</head>")...), 1))
+}
+
+// OEmbedHandler implements an oEmbed provider for public sessions. The
+// embedded player follows the session without the rest of the user
+// interface.
+type OEmbedHandler struct {
+	DBStore Store
+	BaseURL string
+}
+
+func (h *OEmbedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	StatCount("oembed", 1)
+
+	if format := r.URL.Query().Get("format"); format != "" && format != "json" {
+		http.Error(w, "only json is supported", http.StatusNotImplemented)
+		return
+	}
+
+	sessionURL, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || !strings.HasPrefix(sessionURL.Path, "/s/") {
+		http.Error(w, "not a session URL", http.StatusNotFound)
+		return
+	}
+	publicID := strings.TrimPrefix(sessionURL.Path, "/s/")
+
+	summary, err := h.DBStore.GetSessionSummary(publicID)
+	if err != nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	if summary.Visibility != VisibilityPublic {
+		http.Error(w, "session isn't public", http.StatusUnauthorized)
+		return
+	}
+
+	maxWidth, _ := strconv.Atoi(r.URL.Query().Get("maxwidth"))
+	maxHeight, _ := strconv.Atoi(r.URL.Query().Get("maxheight"))
+	width, height := summary.embedSize(maxWidth, maxHeight)
+
+	baseURL := publicBaseURL(h.BaseURL, r)
+	embedURL := baseURL + "/e/" + url.QueryEscape(publicID)
+
+	result := map[string]interface{}{
+		"version":       "1.0",
+		"type":          "rich",
+		"title":         summary.Title,
+		"provider_name": siteName,
+		"provider_url":  baseURL + "/",
+		"width":         width,
+		"height":        height,
+		"html": `<iframe src="` + template.HTMLEscapeString(embedURL) + `" width="` + strconv.Itoa(width) + `" height="` + strconv.Itoa(height) +
+			`" frameborder="0" allowfullscreen></iframe>`,
+	}
+
+	if _, preview := ThumbnailURLs(summary.UploadID, summary.ThumbCount); preview != "" {
+		result["thumbnail_url"] = baseURL + preview
+		result["thumbnail_width"] = thumbnails.PreviewWidth
+		result["thumbnail_height"] = int(thumbnails.PreviewWidth * summary.aspectRatio())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
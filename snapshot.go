@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sort"
+)
+
+// SessionSnapshot describes the complete state of a session up to and
+// including a certain sequence number. It is sent to viewers when they
+// connect, and every command they receive afterwards has a higher sequence
+// number. Notes holds the speaker notes of the current page if the session
+// publishes them.
+type SessionSnapshot struct {
+	Cmd   string             `json:"cmd"`
+	Seq   int                `json:"seq"`
+	Page  int                `json:"page"`
+	Pages map[int][]*Command `json:"pages"`
+	Notes string             `json:"notes,omitempty"`
+	Ended string             `json:"ended,omitempty"`
+}
+
+// buildSnapshot computes the state of a session from its commands, which
+// must be ordered by their sequence numbers.
+func buildSnapshot(seq int, cmds []*Command) *SessionSnapshot {
+	snapshot := &SessionSnapshot{
+		Cmd:   "snapshot",
+		Seq:   seq,
+		Page:  1,
+		Pages: make(map[int][]*Command),
+	}
+
+	for _, cmd := range cmds {
+		switch cmd.Cmd {
+		case "gotoPage":
+			snapshot.Page = cmd.Page
+		case "clearSlide":
+			delete(snapshot.Pages, cmd.Page)
+		case "drawLine":
+			snapshot.Pages[cmd.Page] = append(snapshot.Pages[cmd.Page], cmd)
+		}
+	}
+
+	return snapshot
+}
+
+// Drawings returns the drawing commands of all pages, ordered by page.
+func (snapshot *SessionSnapshot) Drawings() []*Command {
+	pages := make([]int, 0, len(snapshot.Pages))
+	for page := range snapshot.Pages {
+		pages = append(pages, page)
+	}
+	sort.Ints(pages)
+
+	cmds := []*Command{}
+	for _, page := range pages {
+		cmds = append(cmds, snapshot.Pages[page]...)
+	}
+	return cmds
+}
+
+// SessionResume contains the commands that a reconnecting viewer has missed
+// since the last sequence number it received. Seq is the sequence number of
+// the session at the time the commands were read.
+type SessionResume struct {
+	Cmd   string     `json:"cmd"`
+	Seq   int        `json:"seq"`
+	Cmds  []*Command `json:"cmds"`
+	Ended string     `json:"ended,omitempty"`
+}
@@ -0,0 +1,5 @@
+ALTER TABLE commands DROP COLUMN coordinates;
+ALTER TABLE commands DROP COLUMN color;
+ALTER TABLE commands DROP COLUMN width;
+ALTER TABLE commands DROP COLUMN canvas_width;
+ALTER TABLE commands DROP COLUMN canvas_height;
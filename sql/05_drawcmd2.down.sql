@@ -0,0 +1,5 @@
+ALTER TABLE commands MODIFY coordinates TEXT;
+ALTER TABLE commands MODIFY color VARCHAR(7);
+ALTER TABLE commands MODIFY width INTEGER;
+ALTER TABLE commands MODIFY canvas_width INTEGER;
+ALTER TABLE commands MODIFY canvas_height INTEGER;
@@ -0,0 +1 @@
+ALTER TABLE uploads ADD owner VARCHAR(128) NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+ALTER TABLE sessions ADD seq INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE commands ADD seq INTEGER NOT NULL DEFAULT 0;
+
+UPDATE commands SET seq = (SELECT COUNT(*) FROM (SELECT id, session_id FROM commands) AS c WHERE c.session_id = commands.session_id AND c.id <= commands.id);
+UPDATE sessions SET seq = (SELECT COALESCE(MAX(seq), 0) FROM commands WHERE commands.session_id = sessions.id);
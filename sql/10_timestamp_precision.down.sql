@@ -0,0 +1 @@
+ALTER TABLE commands MODIFY timestamp DATETIME NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE commands DROP COLUMN presenter_id;
+DROP TABLE session_presenters;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS session_presenters (
+	session_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	added DATETIME NOT NULL,
+	PRIMARY KEY (session_id, user_id),
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+ALTER TABLE commands ADD presenter_id INTEGER NOT NULL DEFAULT 0;
+
+UPDATE commands SET presenter_id = (SELECT uploads.user_id FROM uploads, sessions WHERE sessions.id = commands.session_id AND uploads.id = sessions.upload_id);
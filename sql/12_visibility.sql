@@ -0,0 +1,9 @@
+ALTER TABLE sessions ADD visibility ENUM('public', 'passcode', 'signedin', 'invite') NOT NULL DEFAULT 'public';
+ALTER TABLE sessions ADD passcode_hash VARCHAR(128) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS session_viewers (
+	session_id INTEGER NOT NULL,
+	username VARCHAR(128) NOT NULL,
+	PRIMARY KEY (session_id, username),
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+);
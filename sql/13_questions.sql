@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS questions (
+	id INTEGER PRIMARY KEY AUTO_INCREMENT NOT NULL,
+	session_id INTEGER NOT NULL,
+	viewer_id VARCHAR(64) NOT NULL,
+	text VARCHAR(1024) NOT NULL,
+	asked DATETIME NOT NULL,
+	state ENUM('open', 'answered', 'hidden') NOT NULL DEFAULT 'open',
+	votes INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS question_votes (
+	question_id INTEGER NOT NULL,
+	viewer_id VARCHAR(64) NOT NULL,
+	PRIMARY KEY (question_id, viewer_id),
+	FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE
+);
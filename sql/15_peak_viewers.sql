@@ -0,0 +1 @@
+ALTER TABLE sessions ADD peak_viewers INTEGER NOT NULL DEFAULT 0;
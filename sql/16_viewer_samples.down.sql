@@ -0,0 +1 @@
+DROP TABLE viewer_samples;
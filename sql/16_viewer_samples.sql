@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS viewer_samples (
+	id INTEGER PRIMARY KEY AUTO_INCREMENT NOT NULL,
+	session_id INTEGER NOT NULL,
+	sampled DATETIME(3) NOT NULL,
+	viewers INTEGER NOT NULL,
+	INDEX (session_id, sampled),
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+ALTER TABLE sessions DROP COLUMN publish_notes;
+DROP TABLE slide_notes;
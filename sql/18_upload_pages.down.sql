@@ -0,0 +1,2 @@
+DROP TABLE upload_pages;
+ALTER TABLE uploads DROP COLUMN pages;
@@ -0,0 +1,11 @@
+ALTER TABLE uploads ADD pages INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS upload_pages (
+	upload_id INTEGER NOT NULL,
+	page INTEGER NOT NULL,
+	width DOUBLE NOT NULL,
+	height DOUBLE NOT NULL,
+	text MEDIUMTEXT NOT NULL,
+	PRIMARY KEY (upload_id, page),
+	FOREIGN KEY (upload_id) REFERENCES uploads(id) ON DELETE CASCADE
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS search_terms (
+	upload_id INTEGER NOT NULL,
+	page INTEGER NOT NULL,
+	term VARCHAR(64) NOT NULL,
+	occurrences INTEGER NOT NULL,
+	PRIMARY KEY (upload_id, page, term),
+	INDEX (term),
+	FOREIGN KEY (upload_id) REFERENCES uploads(id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP TABLE merge_log_uploads;
+DROP TABLE merge_log;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS merge_log (
+	id INTEGER PRIMARY KEY AUTO_INCREMENT NOT NULL,
+	merged DATETIME NOT NULL,
+	account VARCHAR(128) NOT NULL,
+	from_user_id INTEGER NOT NULL,
+	to_user_id INTEGER NOT NULL,
+	INDEX (to_user_id)
+);
+
+CREATE TABLE IF NOT EXISTS merge_log_uploads (
+	merge_id INTEGER NOT NULL,
+	upload_id INTEGER NOT NULL,
+	PRIMARY KEY (merge_id, upload_id),
+	FOREIGN KEY (merge_id) REFERENCES merge_log(id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+UPDATE questions SET state = 'open' WHERE state = 'approved';
+ALTER TABLE questions MODIFY state ENUM('open', 'answered', 'hidden') NOT NULL DEFAULT 'open';
@@ -0,0 +1,4 @@
+ALTER TABLE questions MODIFY state ENUM('open', 'approved', 'answered', 'hidden') NOT NULL DEFAULT 'open';
+
+-- questions used to be public until they were hidden.
+UPDATE questions SET state = 'approved' WHERE state = 'open';
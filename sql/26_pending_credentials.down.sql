@@ -0,0 +1,4 @@
+DELETE FROM credentials WHERE user_id IS NULL;
+ALTER TABLE credentials DROP FOREIGN KEY credentials_pending_user;
+ALTER TABLE credentials DROP COLUMN pending_user_id;
+ALTER TABLE credentials MODIFY user_id INTEGER NOT NULL;
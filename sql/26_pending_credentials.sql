@@ -0,0 +1,5 @@
+-- credentials of unverified email addresses don't belong to a user yet;
+-- pending_user_id is the user that registered them while logged in.
+ALTER TABLE credentials MODIFY user_id INTEGER NULL;
+ALTER TABLE credentials ADD pending_user_id INTEGER NULL,
+	ADD CONSTRAINT credentials_pending_user FOREIGN KEY (pending_user_id) REFERENCES users(id) ON DELETE SET NULL;
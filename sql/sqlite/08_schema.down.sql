@@ -0,0 +1,5 @@
+DROP TABLE commands;
+DROP TABLE sessions;
+DROP TABLE uploads;
+DROP TABLE accounts;
+DROP TABLE users;
@@ -0,0 +1,43 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS accounts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	username VARCHAR(128) UNIQUE NOT NULL,
+	user_id INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS uploads (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	title VARCHAR(256) NOT NULL,
+	public_id VARCHAR(32) NOT NULL,
+	uploaded DATETIME NOT NULL,
+	user_id INTEGER NOT NULL,
+	conversion VARCHAR(8) DEFAULT 'success' CHECK (conversion IN ('progress', 'success', 'error')),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	upload_id INTEGER NOT NULL,
+	public_id VARCHAR(32) NOT NULL,
+	started DATETIME NOT NULL,
+	ended DATETIME,
+	FOREIGN KEY (upload_id) REFERENCES uploads(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS commands (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	session_id INTEGER NOT NULL,
+	cmd VARCHAR(32) NOT NULL,
+	page INTEGER NOT NULL,
+	timestamp DATETIME NOT NULL,
+	coordinates TEXT NOT NULL DEFAULT '',
+	color VARCHAR(7) NOT NULL DEFAULT '',
+	width INTEGER NOT NULL DEFAULT 0,
+	canvas_width INTEGER NOT NULL DEFAULT 0,
+	canvas_height INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+ALTER TABLE commands DROP COLUMN seq;
+ALTER TABLE sessions DROP COLUMN seq;
@@ -0,0 +1 @@
+-- SQLite already stores timestamps with full precision.
@@ -0,0 +1,3 @@
+DROP TABLE session_viewers;
+ALTER TABLE sessions DROP COLUMN passcode_hash;
+ALTER TABLE sessions DROP COLUMN visibility;
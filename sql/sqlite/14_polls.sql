@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS polls (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	session_id INTEGER NOT NULL,
+	presenter_id INTEGER NOT NULL DEFAULT 0,
+	question VARCHAR(1024) NOT NULL,
+	options TEXT NOT NULL,
+	started DATETIME NOT NULL,
+	closed DATETIME,
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+	poll_id INTEGER NOT NULL,
+	viewer_id VARCHAR(64) NOT NULL,
+	option_index INTEGER NOT NULL,
+	voted DATETIME NOT NULL,
+	PRIMARY KEY (poll_id, viewer_id),
+	FOREIGN KEY (poll_id) REFERENCES polls(id) ON DELETE CASCADE
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS viewer_samples (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	session_id INTEGER NOT NULL,
+	sampled DATETIME NOT NULL,
+	viewers INTEGER NOT NULL,
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS viewer_samples_session ON viewer_samples (session_id, sampled);
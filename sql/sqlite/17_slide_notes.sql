@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS slide_notes (
+	upload_id INTEGER NOT NULL,
+	page INTEGER NOT NULL,
+	notes TEXT NOT NULL,
+	PRIMARY KEY (upload_id, page),
+	FOREIGN KEY (upload_id) REFERENCES uploads(id) ON DELETE CASCADE
+);
+
+ALTER TABLE sessions ADD publish_notes INTEGER NOT NULL DEFAULT 0;
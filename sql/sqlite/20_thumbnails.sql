@@ -0,0 +1 @@
+ALTER TABLE uploads ADD thumbnails INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS credentials (
+	email VARCHAR(255) PRIMARY KEY NOT NULL,
+	user_id INTEGER NOT NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	verified INTEGER NOT NULL DEFAULT 0,
+	created DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS email_tokens (
+	token_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+	email VARCHAR(255) NOT NULL,
+	purpose VARCHAR(8) NOT NULL CHECK (purpose IN ('verify', 'reset')),
+	expires DATETIME NOT NULL,
+	FOREIGN KEY (email) REFERENCES credentials(email) ON DELETE CASCADE
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	user_id INTEGER NOT NULL,
+	name VARCHAR(128) NOT NULL,
+	token_hash VARCHAR(64) UNIQUE NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	created DATETIME NOT NULL,
+	last_used DATETIME,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+ALTER TABLE sessions ADD viewer_token VARCHAR(64) NOT NULL DEFAULT '';
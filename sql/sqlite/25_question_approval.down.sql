@@ -0,0 +1,28 @@
+CREATE TABLE questions_old (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	session_id INTEGER NOT NULL,
+	viewer_id VARCHAR(64) NOT NULL,
+	text VARCHAR(1024) NOT NULL,
+	asked DATETIME NOT NULL,
+	state VARCHAR(8) NOT NULL DEFAULT 'open' CHECK (state IN ('open', 'answered', 'hidden')),
+	votes INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+);
+
+INSERT INTO questions_old (id, session_id, viewer_id, text, asked, state, votes)
+	SELECT id, session_id, viewer_id, text, asked, CASE state WHEN 'approved' THEN 'open' ELSE state END, votes FROM questions;
+
+CREATE TABLE question_votes_new AS SELECT question_id, viewer_id FROM question_votes;
+DROP TABLE question_votes;
+DROP TABLE questions;
+ALTER TABLE questions_old RENAME TO questions;
+
+CREATE TABLE question_votes (
+	question_id INTEGER NOT NULL,
+	viewer_id VARCHAR(64) NOT NULL,
+	PRIMARY KEY (question_id, viewer_id),
+	FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE
+);
+
+INSERT INTO question_votes (question_id, viewer_id) SELECT question_id, viewer_id FROM question_votes_new;
+DROP TABLE question_votes_new;
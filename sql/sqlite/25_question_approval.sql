@@ -0,0 +1,32 @@
+-- SQLite can't change the CHECK constraint of a column, so the questions
+-- table is rebuilt. The votes are kept aside meanwhile, as dropping the
+-- questions table would delete them.
+CREATE TABLE questions_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	session_id INTEGER NOT NULL,
+	viewer_id VARCHAR(64) NOT NULL,
+	text VARCHAR(1024) NOT NULL,
+	asked DATETIME NOT NULL,
+	state VARCHAR(8) NOT NULL DEFAULT 'open' CHECK (state IN ('open', 'approved', 'answered', 'hidden')),
+	votes INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+);
+
+-- questions used to be public until they were hidden.
+INSERT INTO questions_new (id, session_id, viewer_id, text, asked, state, votes)
+	SELECT id, session_id, viewer_id, text, asked, CASE state WHEN 'open' THEN 'approved' ELSE state END, votes FROM questions;
+
+CREATE TABLE question_votes_old AS SELECT question_id, viewer_id FROM question_votes;
+DROP TABLE question_votes;
+DROP TABLE questions;
+ALTER TABLE questions_new RENAME TO questions;
+
+CREATE TABLE question_votes (
+	question_id INTEGER NOT NULL,
+	viewer_id VARCHAR(64) NOT NULL,
+	PRIMARY KEY (question_id, viewer_id),
+	FOREIGN KEY (question_id) REFERENCES questions(id) ON DELETE CASCADE
+);
+
+INSERT INTO question_votes (question_id, viewer_id) SELECT question_id, viewer_id FROM question_votes_old;
+DROP TABLE question_votes_old;
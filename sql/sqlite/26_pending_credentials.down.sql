@@ -0,0 +1,28 @@
+CREATE TABLE credentials_old (
+	email VARCHAR(255) PRIMARY KEY NOT NULL,
+	user_id INTEGER NOT NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	verified INTEGER NOT NULL DEFAULT 0,
+	created DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT INTO credentials_old (email, user_id, password_hash, verified, created)
+	SELECT email, user_id, password_hash, verified, created FROM credentials WHERE user_id IS NOT NULL;
+
+CREATE TABLE email_tokens_new AS SELECT token_hash, email, purpose, expires FROM email_tokens
+	WHERE email IN (SELECT email FROM credentials_old);
+DROP TABLE email_tokens;
+DROP TABLE credentials;
+ALTER TABLE credentials_old RENAME TO credentials;
+
+CREATE TABLE email_tokens (
+	token_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+	email VARCHAR(255) NOT NULL,
+	purpose VARCHAR(8) NOT NULL CHECK (purpose IN ('verify', 'reset')),
+	expires DATETIME NOT NULL,
+	FOREIGN KEY (email) REFERENCES credentials(email) ON DELETE CASCADE
+);
+
+INSERT INTO email_tokens (token_hash, email, purpose, expires) SELECT token_hash, email, purpose, expires FROM email_tokens_new;
+DROP TABLE email_tokens_new;
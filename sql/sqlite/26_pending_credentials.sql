@@ -0,0 +1,34 @@
+-- credentials of unverified email addresses don't belong to a user yet;
+-- pending_user_id is the user that registered them while logged in. SQLite
+-- can't drop the NOT NULL constraint of a column, so the credentials table
+-- is rebuilt. The email tokens are kept aside meanwhile, as dropping the
+-- credentials table would delete them.
+CREATE TABLE credentials_new (
+	email VARCHAR(255) PRIMARY KEY NOT NULL,
+	user_id INTEGER NULL,
+	pending_user_id INTEGER NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	verified INTEGER NOT NULL DEFAULT 0,
+	created DATETIME NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (pending_user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+INSERT INTO credentials_new (email, user_id, password_hash, verified, created)
+	SELECT email, user_id, password_hash, verified, created FROM credentials;
+
+CREATE TABLE email_tokens_old AS SELECT token_hash, email, purpose, expires FROM email_tokens;
+DROP TABLE email_tokens;
+DROP TABLE credentials;
+ALTER TABLE credentials_new RENAME TO credentials;
+
+CREATE TABLE email_tokens (
+	token_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+	email VARCHAR(255) NOT NULL,
+	purpose VARCHAR(8) NOT NULL CHECK (purpose IN ('verify', 'reset')),
+	expires DATETIME NOT NULL,
+	FOREIGN KEY (email) REFERENCES credentials(email) ON DELETE CASCADE
+);
+
+INSERT INTO email_tokens (token_hash, email, purpose, expires) SELECT token_hash, email, purpose, expires FROM email_tokens_old;
+DROP TABLE email_tokens_old;
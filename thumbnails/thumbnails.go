@@ -0,0 +1,86 @@
+// Package thumbnails renders images of the pages of PDF files. It uses
+// pdftoppm from poppler-utils.
+package thumbnails
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ThumbnailWidth is the width of page thumbnails in pixels.
+	ThumbnailWidth = 320
+	// PreviewWidth is the width of the preview image in pixels.
+	PreviewWidth = 1200
+	// PreviewName is the file name of the preview image.
+	PreviewName = "preview.png"
+)
+
+// Dir returns the directory that holds the images of a PDF file.
+func Dir(pdfFile string) string {
+	return strings.TrimSuffix(pdfFile, ".pdf") + ".thumbs"
+}
+
+// Name returns the file name of the thumbnail of a page.
+func Name(page int) string {
+	return strconv.Itoa(page) + ".png"
+}
+
+// Render renders a thumbnail of every page of a PDF file and a preview
+// image of its first page into Dir(pdfFile), and returns the number of
+// thumbnails.
+func Render(pdfFile string) (int, error) {
+	dir := Dir(pdfFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	width := strconv.Itoa(ThumbnailWidth)
+	if err := run("-png", "-scale-to-x", width, "-scale-to-y", "-1", pdfFile, path.Join(dir, "page")); err != nil {
+		return 0, err
+	}
+
+	// pdftoppm pads the page numbers with zeros, depending on the number
+	// of pages, so rename the images to something predictable.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "page-") || !strings.HasSuffix(name, ".png") {
+			continue
+		}
+		page, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "page-"), ".png"))
+		if err != nil {
+			continue
+		}
+		if err := os.Rename(path.Join(dir, name), path.Join(dir, Name(page))); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	width = strconv.Itoa(PreviewWidth)
+	previewRoot := path.Join(dir, strings.TrimSuffix(PreviewName, ".png"))
+	if err := run("-png", "-singlefile", "-f", "1", "-l", "1", "-scale-to-x", width, "-scale-to-y", "-1", pdfFile, previewRoot); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func run(args ...string) error {
+	output, err := exec.Command("pdftoppm", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running pdftoppm failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/joinmytalk/xlog"
+)
+
+const (
+	// apiTokenPrefix makes API tokens recognizable, e.g. for secret
+	// scanners.
+	apiTokenPrefix = "sat_"
+
+	maxAPITokens        = 20
+	maxAPITokenNameSize = 128
+)
+
+// Scopes of API tokens.
+const (
+	// ScopeUploads allows to upload, list, search, rename and delete
+	// presentations and to edit their notes.
+	ScopeUploads = "uploads"
+	// ScopeSessions allows to start, stop and delete sessions, to manage
+	// their presenters and access, and to read their questions, polls,
+	// analytics and exports.
+	ScopeSessions = "sessions"
+)
+
+var apiScopes = map[string]bool{ScopeUploads: true, ScopeSessions: true}
+
+// APIToken is a personal token that scripts use to call the API on behalf of
+// a user. Only a hash of the token is stored. Scopes is a space-separated
+// list of the scopes that the token is valid for.
+type APIToken struct {
+	ID        int       `meddler:"id,pk" json:"id"`
+	UserID    int       `meddler:"user_id" json:"-"`
+	Name      string    `meddler:"name" json:"name"`
+	TokenHash string    `meddler:"token_hash" json:"-"`
+	Scopes    string    `meddler:"scopes" json:"scopes"`
+	Created   time.Time `meddler:"created,utctimez" json:"created"`
+	LastUsed  time.Time `meddler:"last_used,utctimez" json:"last_used"`
+}
+
+// HasScope returns whether the token is valid for a scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range strings.Fields(t.Scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type apiTokenKey struct{}
+
+// requestAPIToken returns the API token that a request has been
+// authenticated with by APITokenAuth, or nil.
+func requestAPIToken(r *http.Request) *APIToken {
+	token, _ := r.Context().Value(apiTokenKey{}).(*APIToken)
+	return token
+}
+
+// APITokenAuth authenticates requests that carry an API token in an
+// Authorization: Bearer header.
+type APITokenAuth struct {
+	DBStore Store
+}
+
+// Require returns a handler that accepts API tokens with the specified
+// scope for handler. Requests without a token are passed on unchanged, so
+// that the handler authenticates them with the session cookie as usual.
+func (a *APITokenAuth) Require(scope string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unsupported authorization", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := a.DBStore.GetAPIToken(hashToken(strings.TrimSpace(authorization[7:])))
+		if err != nil {
+			if err != sql.ErrNoRows {
+				xlog.Errorf("Looking up API token failed: %v", err)
+			}
+			StatCount("api token invalid", 1)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		if !token.HasScope(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			http.Error(w, "token lacks scope "+scope, http.StatusForbidden)
+			return
+		}
+
+		if err := a.DBStore.TouchAPIToken(token.ID); err != nil {
+			xlog.Errorf("Updating last use of API token %d failed: %v", token.ID, err)
+		}
+
+		StatCount("api token request", 1)
+
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	})
+}
+
+// TokenSessionStore wraps the session store. For requests that have been
+// authenticated with an API token, it returns a session of the token's user
+// that is never saved, so that the existing handlers work unchanged.
+type TokenSessionStore struct {
+	sessions.Store
+}
+
+// Get returns the session of a request.
+func (s *TokenSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	if requestAPIToken(r) != nil && name == SESSIONNAME {
+		return s.New(r, name)
+	}
+	return s.Store.Get(r, name)
+}
+
+// New returns a new session for a request.
+func (s *TokenSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	if token := requestAPIToken(r); token != nil && name == SESSIONNAME {
+		session := sessions.NewSession(s, name)
+		session.Values["userID"] = token.UserID
+		session.Values["username"] = "token:" + strconv.Itoa(token.ID)
+		return session, nil
+	}
+	return s.Store.New(r, name)
+}
+
+// Save saves a session, unless the request has been authenticated with an
+// API token.
+func (s *TokenSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if requestAPIToken(r) != nil {
+		return nil
+	}
+	return s.Store.Save(r, w, session)
+}
+
+// APITokensHandler lists (GET) and creates (POST) the API tokens of the
+// current user. The token itself is only returned when it is created.
+type APITokensHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *APITokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Errorf("Error fetching session: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	tokens, err := h.DBStore.GetAPITokens(userID)
+	if err != nil {
+		xlog.Errorf("Getting API tokens of userID %d failed: %v", userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+		return
+	}
+
+	data := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" || len(data.Name) > maxAPITokenNameSize {
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+
+	scopes := []string{}
+	seen := make(map[string]bool)
+	for _, scope := range data.Scopes {
+		if !apiScopes[scope] {
+			http.Error(w, "unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		http.Error(w, "no scopes", http.StatusBadRequest)
+		return
+	}
+	sort.Strings(scopes)
+
+	if len(tokens) >= maxAPITokens {
+		http.Error(w, "too many tokens", http.StatusConflict)
+		return
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	secret = apiTokenPrefix + secret
+
+	token := &APIToken{UserID: userID, Name: data.Name, TokenHash: hashToken(secret), Scopes: strings.Join(scopes, " "), Created: time.Now()}
+	if err := h.DBStore.InsertAPIToken(token); err != nil {
+		xlog.Errorf("Inserting API token for userID %d failed: %v", userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	StatCount("api token created", 1)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		*APIToken
+		Token string `json:"token"`
+	}{token, secret})
+}
+
+// RevokeAPITokenHandler deletes an API token of the current user.
+type RevokeAPITokenHandler struct {
+	SessionStore sessions.Store
+	DBStore      Store
+	SecureCookie *securecookie.SecureCookie
+}
+
+func (h *RevokeAPITokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !VerifyXSRFToken(w, r, h.SessionStore, h.SecureCookie) {
+		return
+	}
+
+	session, err := h.SessionStore.Get(r, SESSIONNAME)
+	if err != nil {
+		xlog.Errorf("Error fetching session: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	userID, ok := session.Values["userID"].(int)
+	if !ok {
+		http.Error(w, "authentication required", http.StatusForbidden)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(r.URL.Query().Get(":id"))
+	if err != nil {
+		http.Error(w, "invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.DBStore.DeleteAPIToken(tokenID, userID)
+	if err != nil {
+		xlog.Errorf("Deleting API token %d failed: %v", tokenID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rows == 0 {
+		http.Error(w, "unknown token", http.StatusNotFound)
+		return
+	}
+
+	StatCount("api token revoked", 1)
+
+	w.WriteHeader(http.StatusNoContent)
+}
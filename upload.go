@@ -7,6 +7,7 @@ import (
 	"github.com/joinmytalk/xlog"
 	"github.com/surma-dump/gouuid"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -18,12 +19,16 @@ type Upload struct {
 	UserID     int       `meddler:"user_id" json:"-"`
 	Uploaded   time.Time `meddler:"uploaded,utctimez"`
 	Conversion string    `meddler:"conversion" json:"conversion"`
+	Pages      int       `meddler:"pages" json:"pages"`
+	ThumbCount int       `meddler:"thumbnails" json:"-"`
+	Thumbnails []string  `meddler:"-" json:"thumbnails"`
+	Preview    string    `meddler:"-" json:"preview,omitempty"`
 }
 
 // UploadHandler handles the file upload.
 type UploadHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
 	UploadStore  *FileUploadStore
 	SecureCookie *securecookie.SecureCookie
 }
@@ -69,27 +74,45 @@ func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	id := generateID()
 
-	conversion := "success"
-
-	if isPDF, err := h.UploadStore.Store(id, file, fhdr.Filename); err != nil {
+	src, err := h.UploadStore.Store(id, file, fhdr.Filename)
+	if err != nil {
 		xlog.Errorf("Storing file for upload %s failed: %v", id, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-	} else if !isPDF {
-		conversion = "progress"
+		return
 	}
 
-	if err := h.DBStore.InsertUpload(&Upload{
+	// Uploads stay in progress until pdfd, or satsuma itself for PDF files
+	// if there is no nsqd, has converted them to PDF, if necessary, and has
+	// stored their metadata and thumbnails.
+	userID := session.Values["userID"].(int)
+	uploadEntry := &Upload{
 		PublicID:   id,
-		UserID:     session.Values["userID"].(int),
+		UserID:     userID,
 		Title:      title,
 		Uploaded:   time.Now(),
-		Conversion: conversion,
-	}); err != nil {
+		Conversion: "progress",
+	}
+	if err := h.DBStore.InsertUpload(uploadEntry); err != nil {
 		xlog.Errorf("Insert failed: %v", err)
+		os.Remove(src)
 		http.Error(w, "insert failed", http.StatusInternalServerError)
 		return
 	}
 
+	if err := h.UploadStore.Process(id, src); err != nil {
+		xlog.Errorf("Processing upload %s failed: %v", id, err)
+		if _, err := h.DBStore.DeleteUploadByPublicID(id, userID); err != nil {
+			xlog.Errorf("Deleting upload %s failed: %v", id, err)
+		}
+		os.Remove(src)
+		if err == ErrConversionUnavailable {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"id": id})
 }
@@ -97,7 +120,7 @@ func (h *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // DeleteUploadHandler handles deleting of uploaded files.
 type DeleteUploadHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
 	UploadStore  *FileUploadStore
 	SecureCookie *securecookie.SecureCookie
 }
@@ -146,7 +169,7 @@ func (h *DeleteUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 // RenameUploadHandler handles changing file upload titles.
 type RenameUploadHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
 	SecureCookie *securecookie.SecureCookie
 }
 
@@ -190,7 +213,7 @@ func (h *RenameUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 // GetUploadsHandler returns a list of uploads for the current user.
 type GetUploadsHandler struct {
 	SessionStore sessions.Store
-	DBStore      *Store
+	DBStore      Store
 }
 
 func (h *GetUploadsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -217,6 +240,10 @@ func (h *GetUploadsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for _, upload := range result {
+		upload.Thumbnails, upload.Preview = ThumbnailURLs(upload.PublicID, upload.ThumbCount)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/joinmytalk/xlog"
+	"sync"
+	"time"
+)
+
+// viewerSender delivers a message to a viewer. seq is the sequence number
+// the viewer is at after receiving the message.
+type viewerSender func(seq int, v interface{}) error
+
+// followSession first brings a viewer up to date and then forwards every later
+// command, until the session ends, sending fails or done is closed. Viewers
+// that reconnect with the last sequence number they received only get the
+// commands they missed, everybody else gets a snapshot of the session.
+//
+// It subscribes to the session before reading from the database, so that no
+// command gets lost in between; commands that the viewer already knows are
+// skipped based on their sequence number.
+func followSession(sessionID, lastSeq int, dbStore Store, broker Broker, send viewerSender, done <-chan struct{}) error {
+	sub, err := broker.Subscribe(sessionID)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	seq, ended, err := catchUp(sessionID, lastSeq, dbStore, send)
+	if err != nil || ended {
+		return err
+	}
+
+	connID := generateID()
+	if err := broker.AddViewer(sessionID, connID); err != nil {
+		xlog.Errorf("Registering viewer of session %d failed: %v", sessionID, err)
+	}
+	defer func() {
+		if err := broker.RemoveViewer(sessionID, connID); err != nil {
+			xlog.Errorf("Unregistering viewer of session %d failed: %v", sessionID, err)
+		}
+	}()
+	updatePeakViewers(sessionID, dbStore, broker)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var receiveErr error
+	cmds := make(chan *Command)
+	go func() {
+		defer close(cmds)
+		for {
+			cmd, err := sub.Receive()
+			if err != nil {
+				receiveErr = err
+				return
+			}
+			select {
+			case cmds <- cmd:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case cmd, ok := <-cmds:
+			if !ok {
+				return receiveErr
+			}
+			// unsequenced commands, like questions, are always delivered.
+			if cmd.Seq != 0 && cmd.Seq <= seq {
+				continue
+			}
+			if cmd = viewerCommand(cmd); cmd == nil {
+				continue
+			}
+			StatCount("command for slave", 1)
+			if err := send(cmd.Seq, cmd); err != nil {
+				return err
+			}
+			if cmd.Cmd == "close" {
+				return nil
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// catchUp sends the viewer either the commands since lastSeq or, if that's
+// not possible, a snapshot of the session. It returns the sequence number the
+// viewer is at afterwards and whether the session has ended.
+func catchUp(sessionID, lastSeq int, dbStore Store, send viewerSender) (seq int, ended bool, err error) {
+	if lastSeq > 0 {
+		resume, err := dbStore.GetCommandsSince(sessionID, lastSeq)
+		if err != nil {
+			return 0, false, err
+		}
+
+		// a viewer that is ahead of us must have followed another session
+		// state, e.g. after the database was restored.
+		if lastSeq <= resume.Seq {
+			StatCount("viewer resumed", 1)
+			return resume.Seq, resume.Ended != "", send(resume.Seq, resume)
+		}
+	}
+
+	snapshot, err := dbStore.GetSessionSnapshot(sessionID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return snapshot.Seq, snapshot.Ended != "", send(snapshot.Seq, snapshot)
+}
+
+// receiveViewerMessages handles the messages that a viewer sends over his
+// WebSocket, i.e. questions and poll votes, until the connection is closed.
+func receiveViewerMessages(s *websocket.Conn, sessionID int, viewerID string, dbStore Store, broker Broker) {
+	for {
+		var data json.RawMessage
+		if err := websocket.JSON.Receive(s, &data); err != nil {
+			return
+		}
+
+		msg := struct {
+			Cmd string `json:"cmd"`
+		}{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			xlog.Infof("Decoding message from viewer %q failed: %v", viewerID, err)
+			continue
+		}
+
+		if err := handleViewerMessage(msg.Cmd, data, sessionID, viewerID, dbStore, broker); err != nil {
+			xlog.Infof("Handling %s from viewer %q in session %d failed: %v", msg.Cmd, viewerID, sessionID, err)
+		}
+	}
+}
+
+func handleViewerMessage(cmd string, data json.RawMessage, sessionID int, viewerID string, dbStore Store, broker Broker) error {
+	if viewerID == "" {
+		return errors.New("viewer has no ID")
+	}
+
+	switch cmd {
+	case "askQuestion", "upvoteQuestion":
+		var msg questionMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		return handleQuestionMessage(&msg, sessionID, viewerID, dbStore, broker)
+	case "votePoll":
+		var msg pollMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		return votePoll(&msg, sessionID, viewerID, dbStore, broker)
+	}
+
+	return fmt.Errorf("unknown command %s", cmd)
+}
+
+// updatePeakViewers records the current number of viewers of a session as
+// its peak if it exceeds the previous peak.
+func updatePeakViewers(sessionID int, dbStore Store, broker Broker) {
+	viewers, err := broker.CountViewers(sessionID)
+	if err != nil {
+		xlog.Errorf("Counting viewers of session %d failed: %v", sessionID, err)
+		return
+	}
+
+	if err := dbStore.UpdatePeakViewers(sessionID, viewers); err != nil {
+		xlog.Errorf("Updating peak viewers of session %d failed: %v", sessionID, err)
+	}
+}
+
+// viewerSampleInterval is the interval in which the number of viewers of a
+// running session is recorded for its analytics.
+const viewerSampleInterval = 10 * time.Second
+
+// ViewerSampler records the number of viewers of the sessions that are
+// presented through this satsuma instance once per viewerSampleInterval,
+// no matter how many presenters are connected.
+type ViewerSampler struct {
+	DBStore Store
+	Broker  Broker
+
+	mtx        sync.Mutex
+	presenters map[int]int
+}
+
+// NewViewerSampler creates a new ViewerSampler.
+func NewViewerSampler(dbStore Store, broker Broker) *ViewerSampler {
+	return &ViewerSampler{DBStore: dbStore, Broker: broker, presenters: make(map[int]int)}
+}
+
+// Add registers a presenter connection of a session. The session is sampled
+// as long as it has presenter connections.
+func (vs *ViewerSampler) Add(sessionID int) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+	vs.presenters[sessionID]++
+}
+
+// Remove unregisters a presenter connection of a session.
+func (vs *ViewerSampler) Remove(sessionID int) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+	if vs.presenters[sessionID]--; vs.presenters[sessionID] <= 0 {
+		delete(vs.presenters, sessionID)
+	}
+}
+
+// Run samples the registered sessions forever.
+func (vs *ViewerSampler) Run() {
+	for now := range time.Tick(viewerSampleInterval) {
+		vs.mtx.Lock()
+		sessionIDs := make([]int, 0, len(vs.presenters))
+		for sessionID := range vs.presenters {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+		vs.mtx.Unlock()
+
+		sampled := now.UTC().Truncate(viewerSampleInterval)
+		for _, sessionID := range sessionIDs {
+			viewers, err := vs.Broker.CountViewers(sessionID)
+			if err != nil {
+				xlog.Errorf("Counting viewers of session %d failed: %v", sessionID, err)
+				continue
+			}
+
+			if err := vs.DBStore.InsertViewerSample(&ViewerSample{SessionID: sessionID, Sampled: sampled, Viewers: viewers}); err != nil {
+				xlog.Errorf("Recording viewers of session %d failed: %v", sessionID, err)
+			}
+		}
+	}
+}
@@ -3,17 +3,17 @@ package main
 import (
 	"code.google.com/p/go.net/websocket"
 	"encoding/json"
-	"fmt"
-	"github.com/garyburd/redigo/redis"
+	"errors"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/joinmytalk/xlog"
 	"time"
 )
 
 // WebsocketHandler handles an incoming WebSocket and dispatches to the correct
-// handler based on whether the user is authenticated and whether the session
-// he's viewing belongs to him.
-func WebsocketHandler(s *websocket.Conn, dbStore *Store, sessionStore sessions.Store, redisAddr string) {
+// handler based on whether the user is authenticated and whether he's the
+// owner or a co-presenter of the session he's viewing.
+func WebsocketHandler(s *websocket.Conn, dbStore Store, sessionStore sessions.Store, secureCookie *securecookie.SecureCookie, broker Broker, sampler *ViewerSampler) {
 	StatCount("websocket", 1)
 	xlog.Infof("WebsocketHandler: opened connection")
 	r := s.Request()
@@ -26,6 +26,7 @@ func WebsocketHandler(s *websocket.Conn, dbStore *Store, sessionStore sessions.S
 
 	sessionData := struct {
 		SessionID string `json:"session_id"`
+		LastSeq   int    `json:"last_seq"`
 	}{}
 
 	if err := websocket.JSON.Receive(s, &sessionData); err != nil {
@@ -39,16 +40,19 @@ func WebsocketHandler(s *websocket.Conn, dbStore *Store, sessionStore sessions.S
 		return
 	}
 
-	if session.Values["userID"] == nil {
-		xlog.Errorf("WebsocketHandler is not authenticated -> slave handler")
-		slaveHandler(s, sessionID, dbStore, redisAddr)
-	} else if owner == session.Values["userID"].(int) {
-		xlog.Infof("WebSocketHandler owner matches -> master handler")
-		masterHandler(s, sessionID, dbStore, redisAddr)
-	} else {
-		xlog.Infof("WebSocketHandler owner doesn't match -> slave handler")
-		slaveHandler(s, sessionID, dbStore, redisAddr)
+	if userID, ok := session.Values["userID"].(int); ok && canPresent(dbStore, owner, sessionID, userID) {
+		xlog.Infof("WebSocketHandler user is presenter -> master handler")
+		masterHandler(s, sessionID, userID, dbStore, broker, sampler)
+		return
 	}
+
+	if _, err := authorizeViewer(r, sessionData.SessionID, dbStore, sessionStore, secureCookie); err != nil {
+		xlog.Infof("WebSocketHandler: viewer rejected: %v", err)
+		return
+	}
+
+	xlog.Infof("WebSocketHandler user isn't presenter -> slave handler")
+	slaveHandler(s, sessionID, sessionData.LastSeq, viewerID(r, sessionStore, secureCookie), dbStore, broker)
 }
 
 // Command describes a command as sent over WebSockets and as stored in the database.
@@ -63,87 +67,223 @@ type Command struct {
 	Width        int       `meddler:"width" json:"width"`
 	CanvasWidth  int       `meddler:"canvas_width" json:"canvasWidth"`
 	CanvasHeight int       `meddler:"canvas_height" json:"canvasHeight"`
+	Seq          int       `meddler:"seq" json:"seq"`
+	PresenterID  int       `meddler:"presenter_id" json:"presenter,omitempty"`
+	Question     *Question `meddler:"-" json:"question,omitempty"`
+	Poll         *Poll     `meddler:"-" json:"poll,omitempty"`
+	Notes        string    `meddler:"-" json:"notes,omitempty"`
 }
 
-func slaveHandler(s *websocket.Conn, sessionID int, dbStore *Store, redisAddr string) {
+// slaveHandler forwards the commands of a session to a viewer's WebSocket
+// and handles the questions the viewer sends.
+func slaveHandler(s *websocket.Conn, sessionID, lastSeq int, viewerID string, dbStore Store, broker Broker) {
 	xlog.Debugf("entering SlaveHandler")
-	c, err := redis.Dial("tcp", redisAddr)
-	if err != nil {
-		xlog.Errorf("redis.Dial failed: %v", err)
-		return
+	send := func(seq int, v interface{}) error {
+		return websocket.JSON.Send(s, v)
 	}
-	defer c.Close()
 
-	psc := redis.PubSubConn{Conn: c}
-	topic := fmt.Sprintf("session.%d", sessionID)
-	psc.Subscribe(topic)
-	defer psc.Unsubscribe(topic)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receiveViewerMessages(s, sessionID, viewerID, dbStore, broker)
+	}()
 
-	for {
-		switch v := psc.Receive().(type) {
-		case redis.Message:
-			StatCount("command for slave", 1)
-			var cmd Command
-			if err := json.Unmarshal(v.Data, &cmd); err != nil {
-				break
-			}
-			if err := websocket.JSON.Send(s, cmd); err != nil {
-				xlog.Errorf("slaveHandler: JSON.Send failed: %v", err)
-				return
-			}
-			if cmd.Cmd == "close" {
-				return
-			}
-		case redis.Subscription:
-			xlog.Debugf("mkay... redis.Subscription received: %#v", v)
-		}
+	if err := followSession(sessionID, lastSeq, dbStore, broker, send, done); err != nil {
+		xlog.Errorf("slaveHandler: following session %d failed: %v", sessionID, err)
 	}
 }
 
-func masterHandler(s *websocket.Conn, sessionID int, dbStore *Store, redisAddr string) {
+// masterHandler records and publishes the commands of a presenter, identified
+// by userID, and forwards the commands of all other presenters of the
+// session as well as the audience's questions and votes to him.
+func masterHandler(s *websocket.Conn, sessionID, userID int, dbStore Store, broker Broker, sampler *ViewerSampler) {
 	xlog.Debugf("entering MasterHandler")
-	c, err := redis.Dial("tcp", redisAddr)
+
+	sub, err := broker.Subscribe(sessionID)
 	if err != nil {
-		xlog.Errorf("redis.Dial failed: %v", err)
+		xlog.Errorf("masterHandler: subscribing to session %d failed: %v", sessionID, err)
 		return
 	}
-	defer c.Close()
+	defer sub.Close()
+
+	// 0 means that the page count is unknown, e.g. for documents uploaded
+	// before page counts were recorded.
+	pages, err := dbStore.GetPageCount(sessionID)
+	if err != nil {
+		xlog.Errorf("masterHandler: getting page count of session %d failed: %v", sessionID, err)
+	}
+
+	sampler.Add(sessionID)
+	defer sampler.Remove(sessionID)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	send := newSocketWriter(s, stop)
+	go forwardPresenterCommands(send, sub, userID)
+	go reportViewers(send, sessionID, broker, stop)
 
 	for {
-		var cmd Command
-		if err := websocket.JSON.Receive(s, &cmd); err != nil {
+		var data json.RawMessage
+		if err := websocket.JSON.Receive(s, &data); err != nil {
 			xlog.Errorf("masterHandler: JSON.Receive failed: %v", err)
 			break
 		}
 
+		var cmd Command
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			xlog.Errorf("masterHandler: decoding command failed: %v", err)
+			continue
+		}
+
 		xlog.Debugf("masterHandler: received command: %#v", cmd)
 
-		cmd.SessionID = sessionID
-		cmd.Timestamp = time.Now()
+		if isModerationCommand(cmd.Cmd) {
+			var msg questionMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				xlog.Errorf("masterHandler: decoding %s failed: %v", cmd.Cmd, err)
+				continue
+			}
+			if err := moderateQuestion(&msg, sessionID, dbStore, broker); err != nil {
+				xlog.Errorf("Moderating question %d of session %d failed: %v", msg.QuestionID, sessionID, err)
+			}
+			continue
+		}
 
-		if cmd.Cmd != "clearSlide" {
-			if err := dbStore.InsertCommand(&cmd); err != nil {
-				xlog.Errorf("Inserting command failed: %v", err)
-				break
+		if isPollCommand(cmd.Cmd) {
+			var msg pollMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				xlog.Errorf("masterHandler: decoding %s failed: %v", cmd.Cmd, err)
+				continue
 			}
+			if err := controlPoll(&msg, sessionID, userID, dbStore, broker); err != nil {
+				xlog.Errorf("Handling %s for session %d failed: %v", cmd.Cmd, sessionID, err)
+			}
+			continue
+		}
+
+		if cmd.Cmd == "gotoPage" && (cmd.Page < 1 || (pages > 0 && cmd.Page > pages)) {
+			xlog.Errorf("masterHandler: rejecting gotoPage to page %d of session %d with %d pages", cmd.Page, sessionID, pages)
+			StatCount("invalid page", 1)
+			continue
 		}
 
-		executeCommand(cmd, dbStore)
+		cmd.SessionID = sessionID
+		cmd.Timestamp = time.Now()
+		cmd.PresenterID = userID
+		cmd.Question = nil
+		cmd.Poll = nil
+		cmd.Notes = ""
+
+		if err := executeCommand(&cmd, dbStore); err != nil {
+			xlog.Errorf("Executing %s command for session %d failed: %v", cmd.Cmd, sessionID, err)
+			break
+		}
 
-		cmdJSON, _ := json.Marshal(cmd)
+		if cmd.Cmd == "gotoPage" {
+			if cmd.Notes, err = dbStore.GetPublishedNotes(sessionID, cmd.Page); err != nil {
+				xlog.Errorf("Getting notes for page %d of session %d failed: %v", cmd.Page, sessionID, err)
+			}
+		}
 
-		c.Send("PUBLISH", fmt.Sprintf("session.%d", sessionID), string(cmdJSON))
-		c.Flush()
+		if err := broker.Publish(sessionID, &cmd); err != nil {
+			xlog.Errorf("masterHandler: publishing command failed: %v", err)
+		}
 	}
 	xlog.Debugf("masterHandler: closing connection")
 }
 
-func executeCommand(cmd Command, dbStore *Store) {
+// executeCommand records a command from the master in the database, which
+// also assigns its sequence number.
+func executeCommand(cmd *Command, dbStore Store) error {
 	StatCount("command from master", 1)
-	switch cmd.Cmd {
-	case "clearSlide":
-		if err := dbStore.ClearSlide(cmd.SessionID, cmd.Page); err != nil {
-			xlog.Errorf("clearSlide for %d page %d failed: %v", cmd.SessionID, cmd.Page, err)
+	return dbStore.InsertCommand(cmd)
+}
+
+var errSocketClosed = errors.New("websocket closed")
+
+// newSocketWriter starts the only goroutine that writes to a WebSocket and
+// returns a function that hands messages to it, so that several goroutines
+// can send to the same WebSocket. The writer stops when stop is closed or
+// when sending fails.
+func newSocketWriter(s *websocket.Conn, stop <-chan struct{}) func(v interface{}) error {
+	out := make(chan interface{})
+	failed := make(chan struct{})
+
+	go func() {
+		defer close(failed)
+		for {
+			select {
+			case v := <-out:
+				if err := websocket.JSON.Send(s, v); err != nil {
+					xlog.Errorf("socketWriter: JSON.Send failed: %v", err)
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func(v interface{}) error {
+		select {
+		case out <- v:
+			return nil
+		case <-failed:
+			return errSocketClosed
+		case <-stop:
+			return errSocketClosed
+		}
+	}
+}
+
+// forwardPresenterCommands sends all commands that weren't issued by the
+// presenter identified by userID to his WebSocket, until the subscription
+// is closed.
+func forwardPresenterCommands(send func(v interface{}) error, sub Subscription, userID int) {
+	for {
+		cmd, err := sub.Receive()
+		if err != nil {
+			return
+		}
+		if cmd.PresenterID == userID {
+			continue
+		}
+		if err := send(cmd); err != nil {
+			return
+		}
+	}
+}
+
+// viewersReportInterval is the interval in which presenters are told how
+// many viewers follow their session.
+const viewersReportInterval = 10 * time.Second
+
+// ViewerCount tells presenters how many viewers currently follow their session.
+type ViewerCount struct {
+	Cmd     string `json:"cmd"`
+	Viewers int    `json:"viewers"`
+}
+
+// reportViewers periodically sends the number of viewers of a session to a
+// presenter's WebSocket until stop is closed.
+func reportViewers(send func(v interface{}) error, sessionID int, broker Broker, stop <-chan struct{}) {
+	ticker := time.NewTicker(viewersReportInterval)
+	defer ticker.Stop()
+
+	for {
+		viewers, err := broker.CountViewers(sessionID)
+		if err != nil {
+			xlog.Errorf("Counting viewers of session %d failed: %v", sessionID, err)
+		}
+		if err := send(&ViewerCount{Cmd: "viewers", Viewers: viewers}); err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
 		}
 	}
 }